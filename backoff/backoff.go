@@ -24,7 +24,18 @@
 // All APIs in this package are experimental.
 package backoff
 
-import "time"
+import (
+	"time"
+
+	"github.com/zaba505/gws/internal/rand"
+)
+
+// Strategy defines the methodology for backing off after a failure.
+type Strategy interface {
+	// Backoff returns the amount of time to wait before the next retry given
+	// the number of consecutive failures.
+	Backoff(retries int) time.Duration
+}
 
 // Config defines the configuration options for backoff.
 type Config struct {
@@ -50,3 +61,27 @@ var DefaultConfig = Config{
 	Jitter:     0.2,
 	MaxDelay:   120 * time.Second,
 }
+
+// Backoff implements the Strategy interface, using the exponential backoff
+// algorithm defined in
+// https://github.com/grpc/grpc/blob/master/doc/connection-backoff.md.
+func (bc Config) Backoff(retries int) time.Duration {
+	if retries == 0 {
+		return bc.BaseDelay
+	}
+	backoff, max := float64(bc.BaseDelay), float64(bc.MaxDelay)
+	for backoff < max && retries > 0 {
+		backoff *= bc.Multiplier
+		retries--
+	}
+	if backoff > max {
+		backoff = max
+	}
+	// Randomize backoff delays so that if a cluster of requests start at
+	// the same time, they won't operate in lockstep.
+	backoff *= 1 + bc.Jitter*(rand.Float64()*2-1)
+	if backoff < 0 {
+		return 0
+	}
+	return time.Duration(backoff)
+}
@@ -0,0 +1,200 @@
+package gws
+
+import (
+	"crypto/sha256"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// WithQueryCache configures the client to cache the responses of queries for
+// the given ttl, so identical queries within the ttl are answered without a
+// round trip to the server. A ttl of zero, or less, disables the cache.
+//
+// Queries are identical if their query, variables, operation name and
+// extensions, including any from WithContextInjector, are all equal. Only
+// responses without errors are cached. Mutations and subscriptions are never
+// cached, including when the document passed to Query contains one.
+//
+// Cached responses are shared by every caller, so they must not be modified.
+// Use Client.InvalidateCache to discard every cached response e.g. after a
+// mutation which affects them.
+//
+func WithQueryCache(ttl time.Duration) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.cacheTTL = ttl
+	})
+}
+
+// cacheKey identifies a query by the hash of its request.
+type cacheKey [sha256.Size]byte
+
+type cacheEntry struct {
+	resp    *Response
+	expires time.Time
+}
+
+// queryCache caches query responses until they expire.
+// A nil queryCache caches nothing.
+//
+type queryCache struct {
+	ttl time.Duration
+
+	mu      sync.Mutex
+	entries map[cacheKey]cacheEntry
+}
+
+func newQueryCache(ttl time.Duration) *queryCache {
+	if ttl <= 0 {
+		return nil
+	}
+
+	return &queryCache{
+		ttl:     ttl,
+		entries: make(map[cacheKey]cacheEntry),
+	}
+}
+
+// key returns the key for req and whether or not it may be cached.
+func (c *queryCache) key(req *Request) (cacheKey, bool) {
+	if c == nil || !isQueryDocument(req.Query) {
+		return cacheKey{}, false
+	}
+
+	// encoding/json sorts map keys, so the variables
+	// and extensions are encoded canonically.
+	//
+	b, err := json.Marshal(struct {
+		Query         string                 `json:"query"`
+		Variables     map[string]interface{} `json:"variables"`
+		OperationName string                 `json:"operationName"`
+		Extensions    map[string]interface{} `json:"extensions"`
+	}{req.Query, req.Variables, req.OperationName, req.Extensions})
+	if err != nil {
+		return cacheKey{}, false
+	}
+	return sha256.Sum256(b), true
+}
+
+// get returns the cached response for key, if it hasn't expired.
+func (c *queryCache) get(key cacheKey) (*Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	e, ok := c.entries[key]
+	if !ok {
+		return nil, false
+	}
+	if time.Now().After(e.expires) {
+		delete(c.entries, key)
+		return nil, false
+	}
+	return e.resp, true
+}
+
+// put caches resp, if it's successful, and evicts any expired responses.
+func (c *queryCache) put(key cacheKey, resp *Response, err error) {
+	if err != nil || resp == nil || len(resp.Errors) > 0 {
+		return
+	}
+
+	now := time.Now()
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	for k, e := range c.entries {
+		if now.After(e.expires) {
+			delete(c.entries, k)
+		}
+	}
+	c.entries[key] = cacheEntry{resp: resp, expires: now.Add(c.ttl)}
+}
+
+// invalidate discards every cached response.
+func (c *queryCache) invalidate() {
+	if c == nil {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.entries = make(map[cacheKey]cacheEntry)
+}
+
+// isQueryDocument reports whether the document only contains query
+// operations. Operation keywords are only recognized at the top level
+// of the document, outside of strings and comments.
+//
+func isQueryDocument(doc string) bool {
+	if doc == "" {
+		// e.g. a persisted query sent by its hash alone
+		return false
+	}
+
+	depth := 0
+	for i := 0; i < len(doc); i++ {
+		switch ch := doc[i]; {
+		case ch == '#':
+			for i < len(doc) && doc[i] != '\n' {
+				i++
+			}
+		case ch == '"':
+			i = skipString(doc, i)
+		case ch == '{':
+			depth++
+		case ch == '}':
+			depth--
+		case depth == 0 && isNameStart(ch):
+			j := i
+			for j < len(doc) && isNameChar(doc[j]) {
+				j++
+			}
+
+			// Variables and directives may share the keywords' names
+			isRef := i > 0 && (doc[i-1] == '$' || doc[i-1] == '@')
+			if name := doc[i:j]; !isRef && (name == "mutation" || name == "subscription") {
+				return false
+			}
+			i = j - 1
+		}
+	}
+	return true
+}
+
+// skipString returns the index of the closing quote of the
+// string, or block string, which starts at doc[i].
+//
+func skipString(doc string, i int) int {
+	if len(doc) >= i+3 && doc[i:i+3] == `"""` {
+		for i += 3; i < len(doc); i++ {
+			if doc[i] == '\\' {
+				i++
+				continue
+			}
+			if len(doc) >= i+3 && doc[i:i+3] == `"""` {
+				return i + 2
+			}
+		}
+		return len(doc)
+	}
+
+	for i++; i < len(doc); i++ {
+		switch doc[i] {
+		case '\\':
+			i++
+		case '"':
+			return i
+		}
+	}
+	return len(doc)
+}
+
+func isNameStart(ch byte) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z')
+}
+
+func isNameChar(ch byte) bool {
+	return isNameStart(ch) || ('0' <= ch && ch <= '9')
+}
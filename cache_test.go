@@ -0,0 +1,194 @@
+package gws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestWithQueryCache(t *testing.T) {
+	var calls int64
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		atomic.AddInt64(&calls, 1)
+		defer s.Close()
+
+		if req.OperationName == "failing" {
+			return s.Send(context.TODO(), &Response{Errors: []json.RawMessage{json.RawMessage(`{"message":"failed"}`)}})
+		}
+		return s.Send(context.TODO(), &Response{Data: []byte(`{"hello":"world"}`)})
+	})))
+	defer srv.Close()
+
+	newClient := func(subT *testing.T, ttl time.Duration) Client {
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Fatal(err)
+		}
+		atomic.StoreInt64(&calls, 0)
+		return NewClient(conn, WithQueryCache(ttl))
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	t.Run("Identical", func(subT *testing.T) {
+		client := newClient(subT, time.Minute)
+		defer client.Close()
+
+		for _, vars := range []map[string]interface{}{
+			{"a": 1, "b": map[string]interface{}{"c": "d", "e": "f"}},
+			{"b": map[string]interface{}{"e": "f", "c": "d"}, "a": 1.0},
+		} {
+			resp, err := client.Query(ctx, &Request{Query: "query ($a: Int) { hello }", Variables: vars})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			if string(resp.Data) != `{"hello":"world"}` {
+				subT.Logf("unexpected data: %s", string(resp.Data))
+				subT.Fail()
+				return
+			}
+		}
+
+		if n := atomic.LoadInt64(&calls); n != 1 {
+			subT.Logf("expected a single round trip, but got: %d", n)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Different", func(subT *testing.T) {
+		client := newClient(subT, time.Minute)
+		defer client.Close()
+
+		reqs := []*Request{
+			{Query: "{ hello }"},
+			{Query: "{ hello }", Variables: map[string]interface{}{"a": 1}},
+			{Query: "{ hello }", OperationName: "Hello"},
+			{Query: "{ hello }", Extensions: map[string]interface{}{"tenant": "acme"}},
+		}
+		for _, req := range reqs {
+			_, err := client.Query(ctx, req)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+		}
+
+		if n := atomic.LoadInt64(&calls); n != int64(len(reqs)) {
+			subT.Logf("expected %d round trips, but got: %d", len(reqs), n)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("NeverCached", func(subT *testing.T) {
+		client := newClient(subT, time.Minute)
+		defer client.Close()
+
+		queries := []func() error{
+			func() error {
+				_, err := client.Mutation(ctx, &Request{Query: "{ hello }"})
+				return err
+			},
+			func() error {
+				_, err := client.Query(ctx, &Request{Query: "mutation { hello }"})
+				return err
+			},
+			func() error {
+				_, err := client.Query(ctx, &Request{Query: `# a "comment"
+					query A { hello }
+					mutation B { hello }`, OperationName: "A"})
+				return err
+			},
+			func() error {
+				_, err := client.Query(ctx, &Request{Query: "{ hello }", OperationName: "failing"})
+				return err
+			},
+		}
+		for _, query := range queries {
+			for i := 0; i < 2; i++ {
+				err := query()
+				if err != nil {
+					subT.Error(err)
+					return
+				}
+			}
+		}
+
+		if n := atomic.LoadInt64(&calls); n != int64(2*len(queries)) {
+			subT.Logf("expected %d round trips, but got: %d", 2*len(queries), n)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Expired", func(subT *testing.T) {
+		client := newClient(subT, 50*time.Millisecond)
+		defer client.Close()
+
+		for i := 0; i < 2; i++ {
+			_, err := client.Query(ctx, &Request{Query: "{ hello }"})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			time.Sleep(100 * time.Millisecond)
+		}
+
+		if n := atomic.LoadInt64(&calls); n != 2 {
+			subT.Logf("expected 2 round trips, but got: %d", n)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Invalidated", func(subT *testing.T) {
+		client := newClient(subT, time.Minute)
+		defer client.Close()
+
+		for i := 0; i < 2; i++ {
+			_, err := client.Query(ctx, &Request{Query: "{ hello }"})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			client.InvalidateCache()
+		}
+
+		if n := atomic.LoadInt64(&calls); n != 2 {
+			subT.Logf("expected 2 round trips, but got: %d", n)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestIsQueryDocument(t *testing.T) {
+	testCases := []struct {
+		Doc   string
+		Query bool
+	}{
+		{Doc: "{ hello }", Query: true},
+		{Doc: "query Hello($mutation: Boolean) { hello @subscription }", Query: true},
+		{Doc: `query { search(term: "mutation") { mutation } }`, Query: true},
+		{Doc: `query { search(term: """a "block" mutation""") }`, Query: true},
+		{Doc: "# mutation\nquery { hello }", Query: true},
+		{Doc: "fragment F on Mutation { hello } query { ...F }", Query: true},
+		{Doc: "mutation { hello }"},
+		{Doc: "subscription { hello }"},
+		{Doc: "query A { hello } mutation B { hello }"},
+		{Doc: ""},
+	}
+
+	for _, testCase := range testCases {
+		if isQueryDocument(testCase.Doc) != testCase.Query {
+			t.Logf("expected %q to be a query document: %v", testCase.Doc, testCase.Query)
+			t.Fail()
+		}
+	}
+}
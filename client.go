@@ -4,11 +4,16 @@ package gws
 import (
 	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
+	"sort"
 	"strconv"
+	"strings"
 	"sync"
 	"sync/atomic"
 	"time"
+
+	"github.com/zaba505/gws/backoff"
 )
 
 // ErrUnsubscribed is returned by a subscription receive when the subscription
@@ -16,23 +21,146 @@ import (
 //
 var ErrUnsubscribed = errors.New("gws: received cancelled due to unsubscribe")
 
+// ErrClientClosed is returned for all in-flight and subsequent
+// operations once the client has been closed.
+//
+var ErrClientClosed = errors.New("gws: client is closed")
+
+// ErrKeepAliveTimeout is returned for all in-flight operations when
+// no message is received from the server within the keep alive timeout.
+//
+var ErrKeepAliveTimeout = errors.New("gws: no keep alive received from server")
+
+// ErrInactivityTimeout is returned for all in-flight operations when no
+// message is received from the server, while there are in-flight
+// operations, within the timeout set by WithInactivityTimeout.
+//
+var ErrInactivityTimeout = errors.New("gws: no message received from server")
+
+// ErrQueryTimeout is returned by Query and Mutation when no response is
+// received within the timeout set by WithQueryTimeout.
+//
+var ErrQueryTimeout = errors.New("gws: query timed out")
+
+// ErrPingUnsupported is returned by Ping when the negotiated
+// subprotocol doesn't define ping and pong messages.
+//
+var ErrPingUnsupported = errors.New("gws: ping is not supported by the subprotocol")
+
+// ErrEmptyQuery is returned, without sending anything to the server,
+// when an operation is started with a blank query. See WithAllowEmptyQuery.
+//
+var ErrEmptyQuery = errors.New("gws: query is empty")
+
+// ErrDuplicateOpID is returned when an operation is started with an
+// id which is already in use by another in-flight operation.
+//
+var ErrDuplicateOpID = errors.New("gws: operation id is already in use")
+
+// ErrSubscriptionOverflow is returned by Subscription.Recv, once the buffered
+// responses have been received, when the subscription was ended because its
+// buffer overflowed. See CloseOnOverflow.
+//
+var ErrSubscriptionOverflow = errors.New("gws: subscription buffer overflowed")
+
 // Client provides high-level API for making GraphQL requests over WebSocket.
 type Client interface {
 	// Query provides an RPC like API for performing GraphQL queries.
+	// If the result is delivered incrementally, Query waits for all of it
+	// and returns the initial response with every incremental result, and
+	// error, appended in the order they were received. If the server
+	// completes the query without a result, Query returns an empty response.
+	//
 	Query(context.Context, *Request) (*Response, error)
 
+	// Mutation provides an RPC like API for performing GraphQL mutations.
+	// Mutations aren't idempotent, so they are never replayed when the
+	// client reconnects.
+	//
+	Mutation(context.Context, *Request) (*Response, error)
+
+	// QueryBatch performs all of the queries concurrently, over the same
+	// connection, and returns their responses in the same order. Queries
+	// fail independently of each other, so the error for each query is
+	// returned in the corresponding slot of the returned errors.
+	//
+	QueryBatch(context.Context, []*Request) ([]*Response, []error)
+
 	// Subscribe provides an RPC like API for performing GraphQL subscription queries.
+	// The subscription lasts as long as the context, so once the context is
+	// cancelled, the subscription is unsubscribed and the server told to stop.
+	//
 	Subscribe(context.Context, *Request) (*Subscription, error)
+
+	// Wait blocks until all operations, which are in-flight when it's called,
+	// have completed or the context is cancelled, in which case the context
+	// error is returned. This includes active subscriptions. It is useful
+	// for not losing any responses, before closing the client.
+	//
+	Wait(context.Context) error
+
+	// ActiveOperations returns the ids of all operations, which have
+	// been started but not yet completed, including subscriptions.
+	//
+	ActiveOperations() []OperationID
+
+	// Ping sends a ping to the server and waits for it to respond with
+	// a pong. It is only supported by the "graphql-transport-ws" subprotocol.
+	//
+	Ping(context.Context) error
+
+	// InvalidateCache discards every response cached by WithQueryCache.
+	InvalidateCache()
+
+	// AckPayload returns the payload the server sent with the connection_ack
+	// of the current connection, which changes if the client reconnects. It
+	// returns nil until the connection has been acknowledged.
+	//
+	AckPayload() json.RawMessage
+
+	// Close gracefully terminates the session and closes the underlying
+	// connection. All in-flight and subsequent operations will fail
+	// with ErrClientClosed.
+	//
+	Close() error
 }
 
 // Subscription represents a stream of results corresponding to a GraphQL subscription query.
+//
+// Data and errors are delivered in the order they're received, through Recv:
+//
+//   - A response with GraphQL errors, i.e. Response.Errors is set, doesn't
+//     end the subscription and may be followed by more results.
+//   - An error message is returned from Recv as the error. With "graphql-ws",
+//     it's a *ServerError and the subscription continues until the server
+//     completes it. With "graphql-transport-ws", it's a response with the
+//     GraphQL errors and it ends the subscription, as per the protocol.
+//   - Once the server completes the subscription, or it's unsubscribed,
+//     Recv returns ErrUnsubscribed.
+//
 type Subscription struct {
-	conn   *Conn
-	id     opID
+	id     OperationID
 	respCh <-chan qResp
 
+	// records whether respCh was closed due to an overflow
+	op *operation
+
 	// used to cancel in-flight recv on unsubscribe
 	done chan struct{}
+
+	// stop tells the server to stop the operation
+	stop func() error
+
+	// called with every response received
+	onResponse func(context.Context, *Response, error)
+
+	once sync.Once
+	err  error
+}
+
+// ID returns the id of the subscription's operation.
+func (s *Subscription) ID() OperationID {
+	return s.id
 }
 
 // Recv is a blocking call which waits for either a response from the
@@ -50,43 +178,301 @@ func (s *Subscription) Recv(ctx context.Context) (*Response, error) {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case resp, ok := <-s.respCh:
+		if !ok && s.op != nil && s.op.err == ErrSubscriptionOverflow {
+			return nil, ErrSubscriptionOverflow
+		}
 		if !ok {
 			return nil, ErrUnsubscribed
 		}
+		s.onResponse(ctx, resp.resp, resp.err)
 		return resp.resp, resp.err
 	}
 }
 
+// Responses returns an iterator over the results of the subscription, which
+// is compatible with iter.Seq2, so with Go 1.23 and later it may be ranged
+// over:
+//
+//	for resp, err := range sub.Responses(ctx) {
+//		...
+//	}
+//
+// Each result is yielded as it would be returned by Recv. Iteration ends
+// once the subscription is completed, it overflows or the context is done. The
+// subscription is unsubscribed once iteration ends, including when the
+// loop is broken out of, in which case the server is told to stop.
+//
+func (s *Subscription) Responses(ctx context.Context) func(yield func(*Response, error) bool) {
+	return func(yield func(*Response, error) bool) {
+		defer s.Unsubscribe()
+
+		for {
+			resp, err := s.Recv(ctx)
+			if err == ErrUnsubscribed {
+				return
+			}
+			if !yield(resp, err) || ctx.Err() != nil || err == ErrSubscriptionOverflow {
+				return
+			}
+		}
+	}
+}
+
 // Unsubscribe tells the server to stop sending anymore results
 // and cleans up any resources associated with the subscription.
+// It is safe to call more than once, with subsequent calls simply
+// returning the result of the first.
 //
 func (s *Subscription) Unsubscribe() error {
-	close(s.done)
+	s.once.Do(func() {
+		close(s.done)
+		s.err = s.stop()
+	})
+	return s.err
+}
 
-	select {
-	case <-s.respCh:
-		// Already completed by the server
-		return nil
-	default:
-	}
+// Close implements the io.Closer interface and is equivalent to Unsubscribe.
+// It only stops the subscription, the underlying connection is left open.
+//
+func (s *Subscription) Close() error {
+	return s.Unsubscribe()
+}
 
-	err := s.conn.write(context.TODO(), operationMessage{ID: s.id, Type: gqlStop})
-	if err != nil {
-		return ErrIO{
-			Msg: "failed to send stop message for: " + string(s.id),
-			Err: err,
-		}
-	}
-	return nil
+type clientOpts struct {
+	keepAliveTimeout time.Duration
+	idleTimeout      time.Duration
+	queryTimeout     time.Duration
+	reconnectBackoff backoff.Strategy
+	maxReconnects    int
+	onClose          func(error)
+	newID            func() OperationID
+	reqHook          func(context.Context, *Request)
+	respHook         func(context.Context, *Response, error)
+	allowEmptyQuery  bool
+	injector         func(context.Context) map[string]interface{}
+	stopTimeout      time.Duration
+	cacheTTL         time.Duration
+	subBuffer        int
+	overflow         OverflowPolicy
+}
+
+// ClientOption configures a Client.
+type ClientOption interface {
+	SetClient(*clientOpts)
+}
+
+type coptFn func(*clientOpts)
+
+func (f coptFn) SetClient(opts *clientOpts) { f(opts) }
+
+// WithKeepAliveTimeout configures the client to consider the connection dead
+// if no message, keep alive or otherwise, is received from the server within
+// the given timeout. The connection is then closed and all in-flight
+// operations fail with ErrKeepAliveTimeout.
+//
+func WithKeepAliveTimeout(timeout time.Duration) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.keepAliveTimeout = timeout
+	})
+}
+
+// WithInactivityTimeout configures the client to consider the connection dead
+// if, while there are in-flight operations, no message is received from the
+// server within the given timeout. The connection is then closed and all
+// in-flight operations fail with ErrInactivityTimeout.
+//
+// Unlike WithKeepAliveTimeout, an idle connection is never considered dead,
+// so it may be used with servers which don't send keep alives.
+//
+func WithInactivityTimeout(timeout time.Duration) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.idleTimeout = timeout
+	})
+}
+
+// WithQueryTimeout configures a default timeout for queries and mutations whose
+// context does not already have a deadline. Once the timeout elapses, the
+// operation is stopped and ErrQueryTimeout is returned.
+//
+func WithQueryTimeout(timeout time.Duration) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.queryTimeout = timeout
+	})
+}
+
+// WithCloseHandler registers f to be called, exactly once, when the client
+// stops processing messages from the server. f is called with the error
+// which terminated the client or nil, if the client was closed by Close.
+//
+func WithCloseHandler(f func(error)) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.onClose = f
+	})
+}
+
+// WithReconnect configures the client to automatically re-dial the server,
+// using the given backoff strategy, whenever the connection is lost. A
+// backoff.Config may be used for exponential backoff. Once reconnected,
+// all active subscriptions are re-established with their original ids.
+//
+// In-flight queries are never retried, since they may not be idempotent
+// e.g. mutations, and instead fail with the error which caused the
+// connection to be lost.
+//
+// Reconnecting only applies to connections created with Dial.
+//
+func WithReconnect(bs backoff.Strategy) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.reconnectBackoff = bs
+	})
+}
+
+// WithMaxReconnectAttempts bounds how many consecutive attempts are made to
+// reconnect, before the client gives up. By default, there is no limit.
+//
+// Once the client gives up, it's closed with an ErrReconnectExhausted, which
+// is passed to the WithCloseHandler callback and returned for subsequent
+// operations.
+//
+func WithMaxReconnectAttempts(n int) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.maxReconnects = n
+	})
+}
+
+// WithOpIDGenerator configures how operation ids are generated e.g. to use
+// UUIDs or ids derived from a trace. By default, ids are sequential integers.
+//
+// The generator must be safe for concurrent use. Starting an operation with
+// an id which is still in-flight fails with ErrDuplicateOpID.
+//
+func WithOpIDGenerator(f func() OperationID) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.newID = f
+	})
+}
+
+// WithRequestHook registers f to be called with every request, before it's
+// sent to the server. Hooks may be used to implement tracing, without the
+// client depending on a specific tracing library.
+//
+func WithRequestHook(f func(context.Context, *Request)) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.reqHook = f
+	})
+}
+
+// WithResponseHook registers f to be called with the result of every query
+// and mutation, and with every result received by a subscription.
+//
+func WithResponseHook(f func(context.Context, *Response, error)) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.respHook = f
+	})
+}
+
+// WithStopTimeout configures Subscription.Unsubscribe to wait, at most timeout,
+// for the server to confirm the subscription was stopped with a complete
+// message. If the server never confirms, the subscription is simply
+// forgotten, as it is by default.
+//
+// It only applies to "graphql-ws", since "graphql-transport-ws"
+// servers don't confirm a complete sent by the client.
+//
+func WithStopTimeout(timeout time.Duration) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.stopTimeout = timeout
+	})
+}
+
+// OverflowPolicy determines what happens to a response for a subscription,
+// whose buffer is full because its responses aren't being received quickly
+// enough. See WithSubscriptionBuffer.
+//
+type OverflowPolicy int
+
+const (
+	// Block waits for the subscriber to make room in the buffer. It stalls
+	// reading all responses on the connection, until then. It's the default.
+	//
+	Block OverflowPolicy = iota
+
+	// DropOldest discards the oldest buffered response, to make room.
+	DropOldest
+
+	// DropNewest discards the response, which doesn't fit in the buffer.
+	DropNewest
+
+	// CloseOnOverflow ends the subscription and tells the server to stop
+	// it. Once the buffered responses are received, Recv returns
+	// ErrSubscriptionOverflow.
+	//
+	CloseOnOverflow
+)
+
+// WithSubscriptionBuffer configures how many responses are buffered for
+// each subscription, until they're received, and what happens to responses
+// which don't fit, so a slow subscriber doesn't stall the other operations
+// on the connection. By default, one response is buffered and the policy
+// is Block.
+//
+func WithSubscriptionBuffer(size int, policy OverflowPolicy) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.subBuffer = size
+		opts.overflow = policy
+	})
+}
+
+// WithAllowEmptyQuery disables rejecting operations with a blank query e.g.
+// for servers which identify operations by their extensions instead. Requests
+// created with PersistedQuery are always allowed.
+//
+func WithAllowEmptyQuery() ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.allowEmptyQuery = true
+	})
+}
+
+// WithContextInjector registers f to be called with the context of every
+// query, mutation and subscription. The returned values are merged into
+// the extensions of the outbound request e.g. to propagate a tenant or
+// request id. Extensions set on the request itself take precedence.
+//
+func WithContextInjector(f func(context.Context) map[string]interface{}) ClientOption {
+	return coptFn(func(opts *clientOpts) {
+		opts.injector = f
+	})
 }
 
 // NewClient takes a connection and initializes a client over it.
-func NewClient(conn *Conn) Client {
+func NewClient(conn *Conn, opts ...ClientOption) Client {
+	copts := new(clientOpts)
+	for _, opt := range opts {
+		opt.SetClient(copts)
+	}
+
 	c := &client{
-		conn:  conn,
-		subs:  make(map[opID]chan<- qResp),
-		ready: make(chan struct{}, 1),
-		done:  make(chan struct{}, 1),
+		conn:             conn,
+		keepAliveTimeout: copts.keepAliveTimeout,
+		queryTimeout:     copts.queryTimeout,
+		reconnectBackoff: copts.reconnectBackoff,
+		maxReconnects:    copts.maxReconnects,
+		onClose:          copts.onClose,
+		newID:            copts.newID,
+		reqHook:          copts.reqHook,
+		respHook:         copts.respHook,
+		allowEmptyQuery:  copts.allowEmptyQuery,
+		injector:         copts.injector,
+		stopTimeout:      copts.stopTimeout,
+		watchdog:         newWatchdog(copts.idleTimeout),
+		cache:            newQueryCache(copts.cacheTTL),
+		subBuffer:        copts.subBuffer,
+		overflow:         copts.overflow,
+		metrics:          conn.metrics,
+		subs:             make(map[OperationID]*operation),
+		ready:            make(chan struct{}, 1),
+		done:             make(chan struct{}, 1),
+		closed:           make(chan struct{}, 1),
 	}
 
 	go c.run()
@@ -95,15 +481,41 @@ func NewClient(conn *Conn) Client {
 }
 
 type client struct {
-	conn *Conn
+	connMu sync.RWMutex
+	conn   *Conn
+
+	keepAliveTimeout time.Duration
+	queryTimeout     time.Duration
+	reconnectBackoff backoff.Strategy
+	maxReconnects    int
+	onClose          func(error)
+	newID            func() OperationID
+	reqHook          func(context.Context, *Request)
+	respHook         func(context.Context, *Response, error)
+	allowEmptyQuery  bool
+	injector         func(context.Context) map[string]interface{}
+	stopTimeout      time.Duration
+	watchdog         *watchdog
+	cache            *queryCache
+	subBuffer        int
+	overflow         OverflowPolicy
+	metrics          Metrics
 
 	id     uint64
 	subsMu sync.Mutex
-	subs   map[opID]chan<- qResp
+	subs   map[OperationID]*operation
+
+	// waiting on a pong
+	pingMu  sync.Mutex
+	pingers []chan struct{}
 
 	err   error
 	ready chan struct{}
 	done  chan struct{}
+
+	closeOnce sync.Once
+	closeErr  error
+	closed    chan struct{}
 }
 
 // ErrUnexpectedMessage represents a unexpected message type.
@@ -148,83 +560,242 @@ func (e ErrIO) Unwrap() error {
 	return e.Err
 }
 
+// ErrReconnectExhausted represents the client giving up on reconnecting
+// after the number of attempts set by WithMaxReconnectAttempts.
+//
+type ErrReconnectExhausted struct {
+	// Attempts is how many reconnects were attempted.
+	Attempts int
+
+	// Err is the error from the last attempt.
+	Err error
+}
+
+// Error implements the error interface.
+func (e ErrReconnectExhausted) Error() string {
+	return "gws: gave up reconnecting after " + strconv.Itoa(e.Attempts) + " attempts: " + e.Err.Error()
+}
+
+// Unwrap is for the errors package to use within its As, Is, and Unwrap functions.
+func (e ErrReconnectExhausted) Unwrap() error {
+	return e.Err
+}
+
 const defaultTimeout = 5 * time.Second
 
 func (c *client) initConn(timeout time.Duration) error {
-	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
-	err := c.conn.write(ctx, operationMessage{Type: gqlConnectionInit})
-	cancel()
-	if err != nil {
-		return ErrIO{
-			Msg: "failed to send connection_init",
-			Err: err,
-		}
+	conn := c.getConn()
+	if conn.acked {
+		// Dial has already performed the handshake
+		return nil
 	}
 
-	ctx, cancel = context.WithTimeout(context.Background(), defaultTimeout)
-	b, err := c.conn.read(ctx)
-	cancel()
-	if err != nil {
-		return ErrIO{
-			Msg: "failed to receive connection_ack",
-			Err: err,
-		}
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
 
-	ackMsg := new(operationMessage)
-	err = ackMsg.UnmarshalJSON(b)
+	acked, err := conn.handshake(ctx)
 	if err != nil {
 		return err
 	}
-	if ackMsg.Type != gqlConnectionAck {
-		return ErrUnexpectedMessage{
-			Expected: string(gqlConnectionAck),
-			Received: string(ackMsg.Type),
-		}
+	if acked != conn && !c.swapConn(acked) {
+		acked.Close()
+		return ErrClientClosed
 	}
-
 	return nil
 }
 
 func (c *client) processMessages(msgs <-chan operationMessage) {
-	var err error
 	for msg := range msgs {
 		switch msg.Type {
-		case gqlData, gqlError:
-			r, ok := msg.Payload.(*Response)
-			if !ok {
-				err, _ = msg.Payload.(*ServerError)
+		case gqlData, gqlNext, gqlError:
+			var err error
+			r, _ := msg.Payload.(*Response)
+			if serr, ok := msg.Payload.(*ServerError); ok {
+				err = serr
 			}
 
 			c.subsMu.Lock()
-			respCh := c.subs[msg.ID]
+			op, ok := c.subs[msg.ID]
 			c.subsMu.Unlock()
+			if !ok {
+				// The operation is no longer being tracked
+				break
+			}
 
-			respCh <- qResp{resp: r, err: err}
+			if op.sub && c.overflow != Block {
+				c.deliver(msg.ID, op, qResp{resp: r, err: err})
+			} else {
+				// Nobody may be receiving once the client is closed, so
+				// don't block the read loop from observing the close.
+				//
+				select {
+				case op.respCh <- qResp{resp: r, err: err}:
+				case <-op.done:
+				case <-c.closed:
+				}
+			}
+
+			// "graphql-transport-ws" doesn't follow an error with a complete
+			if msg.Type == gqlError && c.getConn().proto == SubprotocolGraphQLTransportWS {
+				c.complete(msg.ID)
+			}
+
+			// The final incremental result completes a query, since the server
+			// may not send a complete. For subscriptions, it only completes the
+			// current event, so they're left to the complete.
+			//
+			if op.sub || r == nil {
+				break
+			}
+			if r.HasNext {
+				op.incremental = true
+			} else if op.incremental {
+				c.complete(msg.ID)
+			}
 		case gqlComplete:
-			c.subsMu.Lock()
-			respCh := c.subs[msg.ID]
-			delete(c.subs, msg.ID)
-			c.subsMu.Unlock()
+			c.complete(msg.ID)
+		}
+	}
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	for id, op := range c.subs {
+		op.err = c.err
+		close(op.respCh)
+		delete(c.subs, id)
+		c.ended(op)
+	}
+}
+
+// deliver sends a response to a subscription, without blocking, by applying
+// the overflow policy when the subscription's buffer is full.
+//
+func (c *client) deliver(id OperationID, op *operation, r qResp) {
+	for {
+		select {
+		case op.respCh <- r:
+			return
+		default:
+		}
+
+		switch c.overflow {
+		case DropNewest:
+			return
+		case CloseOnOverflow:
+			op.err = ErrSubscriptionOverflow
+			c.complete(id)
+			go c.getConn().write(context.Background(), operationMessage{ID: id, Type: gqlStop})
+			return
+		}
 
-			close(respCh)
+		// Make room, unless the subscriber already has
+		select {
+		case <-op.respCh:
+		default:
 		}
 	}
+}
+
+// complete stops tracking an operation and closes its response channel.
+func (c *client) complete(id OperationID) {
+	c.subsMu.Lock()
+	op, ok := c.subs[id]
+	delete(c.subs, id)
+	c.subsMu.Unlock()
+	if !ok {
+		// Most likely the complete for a stopped operation
+		return
+	}
+
+	close(op.respCh)
+	c.ended(op)
+}
+
+// nextID returns the id for a new operation.
+func (c *client) nextID() OperationID {
+	if c.newID != nil {
+		return c.newID()
+	}
+
+	id := atomic.AddUint64(&c.id, 1)
+	return OperationID(strconv.FormatUint(id, 10))
+}
+
+// register starts tracking a new operation.
+func (c *client) register(id OperationID, req *Request, sub bool) (*operation, error) {
+	op := &operation{
+		req:    req,
+		sub:    sub,
+		respCh: make(chan qResp, c.bufferSize(sub)),
+		done:   make(chan struct{}, 1),
+		ended:  make(chan struct{}),
+	}
+
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	if _, ok := c.subs[id]; ok {
+		return nil, ErrDuplicateOpID
+	}
+	c.subs[id] = op
+	c.watchdog.add(1)
+	if sub {
+		c.metrics.AddSubscriptions(1)
+	}
+
+	return op, nil
+}
+
+// bufferSize returns how many responses are buffered for an operation.
+func (c *client) bufferSize(sub bool) int {
+	if !sub || c.subBuffer <= 0 {
+		return 1
+	}
+	return c.subBuffer
+}
+
+// ended reports that an operation is no longer tracked.
+func (c *client) ended(op *operation) {
+	close(op.ended)
+	c.watchdog.add(-1)
+	if op.sub {
+		c.metrics.AddSubscriptions(-1)
+	}
+}
 
+// unregister stops tracking the operation and reports
+// whether or not the operation was still being tracked.
+//
+func (c *client) unregister(id OperationID) bool {
 	c.subsMu.Lock()
 	defer c.subsMu.Unlock()
 
-	for _, respCh := range c.subs {
-		close(respCh)
+	op, ok := c.subs[id]
+	delete(c.subs, id)
+	if ok {
+		c.ended(op)
 	}
+	return ok
+}
+
+// setErr records the error which terminated the client.
+func (c *client) setErr(err error) {
+	select {
+	case <-c.closed:
+		err = ErrClientClosed
+	default:
+	}
+	c.err = err
 }
 
 func (c *client) run() {
+	defer c.notifyClose()
 	defer close(c.done)
 
 	err := c.initConn(defaultTimeout)
 	if err != nil {
-		c.err = err
+		c.setErr(err)
 		return
 	}
 	close(c.ready)
@@ -234,69 +805,428 @@ func (c *client) run() {
 
 	go c.processMessages(msgs)
 
-	msg := new(operationMessage)
 	for {
-		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
-		b, err := c.conn.read(ctx)
-		cancel()
-		if err != nil {
-			c.err = ErrIO{
-				Msg: "failed to read",
-				Err: err,
-			}
+		err = c.readMessages(msgs)
+		if !c.shouldReconnect(err) {
+			c.setErr(err)
 			return
 		}
 
-		err = msg.UnmarshalJSON(b)
+		err = c.reconnect(msgs, err)
 		if err != nil {
-			c.err = err
+			c.setErr(err)
 			return
 		}
-
-		msgs <- *msg
-
-		msg.ID = ""
-		msg.Payload = nil
-		msg.Type = ""
 	}
 }
 
-type qResp struct {
-	resp *Response
-	err  error
-}
-
-type qReq struct {
-	*Request
-	resp chan qResp
-}
-
-func (c *client) Query(ctx context.Context, req *Request) (*Response, error) {
+// terminated returns the error which terminated the client, if it has been.
+func (c *client) terminated() error {
 	select {
-	case <-ctx.Done():
-		return nil, ctx.Err()
-	case <-c.ready:
-		break
 	case <-c.done:
-		return nil, c.err
+		return c.err
+	default:
+		return nil
 	}
+}
 
-	id := atomic.AddUint64(&c.id, 1)
-	oid := opID(strconv.FormatUint(id, 10))
-	msg := operationMessage{
-		ID:      oid,
-		Type:    gqlStart,
-		Payload: req,
+// notifyClose calls the close handler, if any, with the terminal error.
+func (c *client) notifyClose() {
+	if c.onClose == nil {
+		return
 	}
 
-	respCh := make(chan qResp, 1)
+	err := c.err
+	if err == ErrClientClosed {
+		err = nil
+	}
+	c.onClose(err)
+}
 
-	c.subsMu.Lock()
-	c.subs[oid] = respCh
-	c.subsMu.Unlock()
+// readMessages reads messages from the current connection
+// until an error is encountered.
+//
+func (c *client) readMessages(msgs chan<- operationMessage) error {
+	conn := c.getConn()
 
-	err := c.conn.write(ctx, msg)
-	if err != nil {
+	// The watchdog cancels reads once operations have been inactive for too long
+	rctx, rcancel := context.WithCancel(context.Background())
+	defer rcancel()
+	c.watchdog.watch(rcancel)
+
+	msg := new(operationMessage)
+	for {
+		// Without a keep alive timeout, the connection may
+		// simply be idle, so there's no deadline to enforce.
+		//
+		ctx, cancel := rctx, context.CancelFunc(func() {})
+		if c.keepAliveTimeout > 0 {
+			// The timeout is reset upon receiving any message
+			ctx, cancel = context.WithTimeout(ctx, c.keepAliveTimeout)
+		}
+		b, err := conn.read(ctx)
+		cancel()
+		if err != nil && c.watchdog.timedOut() {
+			return ErrInactivityTimeout
+		}
+		if err != nil && c.keepAliveTimeout > 0 && errors.Is(err, context.DeadlineExceeded) {
+			return ErrKeepAliveTimeout
+		}
+		if err != nil {
+			return ErrIO{
+				Msg: "failed to read",
+				Err: err,
+			}
+		}
+		c.watchdog.received()
+
+		msg.ID = ""
+		msg.Payload = nil
+		msg.Type = ""
+
+		err = msg.unmarshal(conn.codec, b)
+		var typErr ErrUnsupportedMsgType
+		if errors.As(err, &typErr) {
+			// For forward compatibility, simply ignore
+			// any message types we don't know about.
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		conn.received(msg)
+
+		switch msg.Type {
+		case gqlConnectionError:
+			return asConnectionError(msg)
+		case gqlPing:
+			c.pong(conn, msg.Payload)
+			continue
+		case gqlPong:
+			c.notifyPingers()
+			continue
+		}
+
+		msgs <- *msg
+	}
+}
+
+// shouldReconnect reports whether the client should attempt
+// to reconnect after the connection failed with err.
+//
+func (c *client) shouldReconnect(err error) bool {
+	if c.reconnectBackoff == nil || c.isClosed() || c.getConn().dopts == nil {
+		return false
+	}
+
+	var ioErr ErrIO
+	return errors.As(err, &ioErr) || errors.Is(err, ErrKeepAliveTimeout) || errors.Is(err, ErrInactivityTimeout)
+}
+
+// reconnect re-dials the server, with backoff, and re-establishes all
+// active subscriptions. In-flight queries are failed with cause, since
+// it is unknown whether or not the server processed them.
+//
+func (c *client) reconnect(msgs chan<- operationMessage, cause error) error {
+	c.subsMu.Lock()
+	var queries []OperationID
+	for id, op := range c.subs {
+		if op.sub {
+			continue
+		}
+		op.err = cause
+		queries = append(queries, id)
+	}
+	c.subsMu.Unlock()
+
+	// Let processMessages close the response channels, so
+	// they aren't closed out from underneath it.
+	for _, id := range queries {
+		msgs <- operationMessage{ID: id, Type: gqlComplete}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go func() {
+		select {
+		case <-c.closed:
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	old := c.getConn()
+	err := cause
+	for attempt := 0; c.maxReconnects <= 0 || attempt < c.maxReconnects; attempt++ {
+		timer := time.NewTimer(c.reconnectBackoff.Backoff(attempt))
+		select {
+		case <-timer.C:
+		case <-ctx.Done():
+			timer.Stop()
+			return ErrClientClosed
+		}
+
+		old.logger.Debug("reconnecting", "attempt", attempt+1, "err", err)
+
+		var conn *Conn
+		conn, err = old.redial(ctx)
+		if err != nil {
+			continue
+		}
+
+		if !conn.acked {
+			ictx, icancel := context.WithTimeout(ctx, defaultTimeout)
+			conn, err = conn.handshake(ictx)
+			icancel()
+			if err != nil {
+				continue
+			}
+		}
+
+		// Snapshot before swapping, so operations started
+		// on the new connection aren't started twice.
+		//
+		subs := c.subscriptions()
+		if !c.swapConn(conn) {
+			conn.Close()
+			return ErrClientClosed
+		}
+		go old.Close()
+
+		c.resubscribe(ctx, conn, subs)
+		return nil
+	}
+	return ErrReconnectExhausted{Attempts: c.maxReconnects, Err: err}
+}
+
+// swapConn replaces the current connection with conn,
+// unless the client has been closed.
+//
+func (c *client) swapConn(conn *Conn) bool {
+	c.connMu.Lock()
+	defer c.connMu.Unlock()
+
+	if c.isClosed() {
+		return false
+	}
+	c.conn = conn
+	return true
+}
+
+// subscriptions returns all active subscriptions.
+func (c *client) subscriptions() map[OperationID]*operation {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	subs := make(map[OperationID]*operation)
+	for id, op := range c.subs {
+		if op.sub {
+			subs[id] = op
+		}
+	}
+	return subs
+}
+
+// resubscribe restarts the given subscriptions on conn with their original ids.
+func (c *client) resubscribe(ctx context.Context, conn *Conn, subs map[OperationID]*operation) {
+	for id, op := range subs {
+		c.subsMu.Lock()
+		active := c.subs[id] == op
+		c.subsMu.Unlock()
+		if !active {
+			// Unsubscribed while reconnecting
+			continue
+		}
+
+		// A failed write will surface as a read error,
+		// which triggers yet another reconnect.
+		conn.write(ctx, operationMessage{ID: id, Type: gqlStart, Payload: op.req})
+	}
+}
+
+func (c *client) getConn() *Conn {
+	c.connMu.RLock()
+	defer c.connMu.RUnlock()
+	return c.conn
+}
+
+type qResp struct {
+	resp *Response
+	err  error
+}
+
+type qReq struct {
+	*Request
+	resp chan qResp
+}
+
+// operation represents an in-flight query or subscription.
+type operation struct {
+	req *Request
+	sub bool
+
+	respCh chan qResp
+
+	// closed once the caller is no longer interested in responses
+	done chan struct{}
+
+	// set before respCh is closed, if the operation failed
+	err error
+
+	// set by processMessages once a query's result is delivered incrementally
+	incremental bool
+
+	// closed once the operation is no longer tracked
+	ended chan struct{}
+}
+
+func (c *client) Query(ctx context.Context, req *Request) (*Response, error) {
+	return c.do(ctx, req, c.cache)
+}
+
+func (c *client) Mutation(ctx context.Context, req *Request) (*Response, error) {
+	return c.do(ctx, req, nil)
+}
+
+func (c *client) QueryBatch(ctx context.Context, reqs []*Request) ([]*Response, []error) {
+	resps := make([]*Response, len(reqs))
+	errs := make([]error, len(reqs))
+
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+	for i, req := range reqs {
+		go func(i int, req *Request) {
+			defer wg.Done()
+			resps[i], errs[i] = c.do(ctx, req, c.cache)
+		}(i, req)
+	}
+	wg.Wait()
+
+	return resps, errs
+}
+
+// do performs a single request/response operation, unless its
+// response is already in the cache, which may be nil.
+//
+func (c *client) do(ctx context.Context, req *Request, cache *queryCache) (*Response, error) {
+	req = c.inject(ctx, req)
+	key, cacheable := cache.key(req)
+	if cacheable {
+		if resp, ok := cache.get(key); ok {
+			return resp, nil
+		}
+	}
+
+	c.onRequest(ctx, req)
+	start := time.Now()
+	resp, err := c.send(ctx, req)
+	c.metrics.ObserveQuery(time.Since(start), err)
+	c.onResponse(ctx, resp, err)
+	if cacheable {
+		cache.put(key, resp, err)
+	}
+	return resp, err
+}
+
+// inject merges the values from the context injector into the request
+// extensions. The request is copied, so the caller's isn't modified.
+//
+func (c *client) inject(ctx context.Context, req *Request) *Request {
+	if c.injector == nil {
+		return req
+	}
+
+	vals := c.injector(ctx)
+	if len(vals) == 0 {
+		return req
+	}
+
+	ext := make(map[string]interface{}, len(vals)+len(req.Extensions))
+	for k, v := range vals {
+		ext[k] = v
+	}
+	for k, v := range req.Extensions {
+		ext[k] = v
+	}
+
+	r := *req
+	r.Extensions = ext
+	return &r
+}
+
+func (c *client) onRequest(ctx context.Context, req *Request) {
+	if c.reqHook != nil {
+		c.reqHook(ctx, req)
+	}
+}
+
+func (c *client) onResponse(ctx context.Context, resp *Response, err error) {
+	if c.respHook != nil {
+		c.respHook(ctx, resp, err)
+	}
+}
+
+// send performs the operation, while handling persisted queries.
+func (c *client) send(ctx context.Context, req *Request) (*Response, error) {
+	if !req.isPersisted() || req.Query == "" {
+		return c.roundTrip(ctx, req)
+	}
+
+	hashOnly := *req
+	hashOnly.Query = ""
+	resp, err := c.roundTrip(ctx, &hashOnly)
+	if err != nil || resp == nil || !resp.persistedQueryNotFound() {
+		return resp, err
+	}
+	return c.roundTrip(ctx, req)
+}
+
+func (c *client) roundTrip(ctx context.Context, req *Request) (*Response, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	if err := c.validate(req); err != nil {
+		return nil, err
+	}
+
+	var timeout bool
+	if _, ok := ctx.Deadline(); !ok && c.queryTimeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, c.queryTimeout)
+		defer cancel()
+		timeout = true
+	}
+
+	select {
+	case <-ctx.Done():
+		if timeout && ctx.Err() == context.DeadlineExceeded {
+			return nil, ErrQueryTimeout
+		}
+		return nil, ctx.Err()
+	case <-c.ready:
+		// A terminated client was ready too, so its error takes precedence
+		if err := c.terminated(); err != nil {
+			return nil, err
+		}
+	case <-c.done:
+		return nil, c.err
+	}
+
+	oid := c.nextID()
+	op, err := c.register(oid, req, false)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := operationMessage{
+		ID:      oid,
+		Type:    gqlStart,
+		Payload: req,
+	}
+
+	err = c.getConn().write(ctx, msg)
+	if err != nil {
+		c.unregister(oid)
 		return nil, ErrIO{
 			Msg: "failed to send query",
 			Err: err,
@@ -307,67 +1237,454 @@ func (c *client) Query(ctx context.Context, req *Request) (*Response, error) {
 	case <-c.done:
 		return nil, c.err
 	case <-ctx.Done():
-		go stopReq(c.conn, oid, respCh)
-		return nil, ctx.Err()
-	case resp, ok := <-respCh:
+		return nil, c.abandon(ctx, oid, op, timeout)
+	case r, ok := <-op.respCh:
+		if !ok && c.isClosed() {
+			return nil, ErrClientClosed
+		}
+		if !ok && op.err != nil {
+			return nil, op.err
+		}
 		if !ok {
+			// Completed without a result e.g. an empty result set
+			return &Response{}, nil
+		}
+		if r.err != nil || r.resp == nil || !r.resp.HasNext {
+			return r.resp, r.err
+		}
+		return c.collect(ctx, oid, op, r.resp, timeout)
+	}
+}
+
+// abandon stops a query, whose context is done, and returns the error for it.
+func (c *client) abandon(ctx context.Context, oid OperationID, op *operation, timeout bool) error {
+	close(op.done)
+	if c.unregister(oid) {
+		go stopReq(c.getConn(), oid)
+	}
+	if timeout && ctx.Err() == context.DeadlineExceeded {
+		return ErrQueryTimeout
+	}
+	return ctx.Err()
+}
+
+// collect receives the remaining incremental results of a query and appends
+// them to its initial response, until the server indicates there are no more.
+//
+func (c *client) collect(ctx context.Context, oid OperationID, op *operation, resp *Response, timeout bool) (*Response, error) {
+	for resp.HasNext {
+		select {
+		case <-c.done:
 			return nil, c.err
+		case <-ctx.Done():
+			return nil, c.abandon(ctx, oid, op, timeout)
+		case r, ok := <-op.respCh:
+			if !ok && c.isClosed() {
+				return nil, ErrClientClosed
+			}
+			if !ok && op.err != nil {
+				return nil, op.err
+			}
+			if !ok {
+				// Completed without a final result
+				resp.HasNext = false
+				return resp, nil
+			}
+			if r.err != nil || r.resp == nil {
+				return r.resp, r.err
+			}
+			resp.Incremental = append(resp.Incremental, r.resp.Incremental...)
+			resp.Errors = append(resp.Errors, r.resp.Errors...)
+			resp.HasNext = r.resp.HasNext
 		}
-		return resp.resp, resp.err
 	}
+	return resp, nil
 }
 
 func (c *client) Subscribe(ctx context.Context, req *Request) (*Subscription, error) {
+	if c.isClosed() {
+		return nil, ErrClientClosed
+	}
+	req = c.inject(ctx, req)
+	if err := c.validate(req); err != nil {
+		return nil, err
+	}
+
 	select {
 	case <-ctx.Done():
 		return nil, ctx.Err()
 	case <-c.ready:
-		break
+		// A terminated client was ready too, so its error takes precedence
+		if err := c.terminated(); err != nil {
+			return nil, err
+		}
 	case <-c.done:
 		return nil, c.err
 	}
 
-	id := atomic.AddUint64(&c.id, 1)
-	oid := opID(strconv.FormatUint(id, 10))
+	oid := c.nextID()
+	op, err := c.register(oid, req, true)
+	if err != nil {
+		return nil, err
+	}
+
+	c.onRequest(ctx, req)
+
 	msg := operationMessage{
 		ID:      oid,
 		Type:    gqlStart,
 		Payload: req,
 	}
 
-	respCh := make(chan qResp, 1)
+	err = c.getConn().write(ctx, msg)
+	if err != nil {
+		c.unregister(oid)
+		return nil, ErrIO{
+			Msg: "failed to send query",
+			Err: err,
+		}
+	}
+
+	sub := &Subscription{
+		id:         oid,
+		respCh:     op.respCh,
+		op:         op,
+		done:       op.done,
+		stop:       func() error { return c.stop(oid) },
+		onResponse: c.onResponse,
+	}
+
+	if ctx.Done() != nil {
+		go func() {
+			select {
+			case <-ctx.Done():
+				sub.Unsubscribe()
+			case <-op.done:
+			case <-op.ended:
+			}
+		}()
+	}
+	return sub, nil
+}
+
+func (c *client) ActiveOperations() []OperationID {
+	c.subsMu.Lock()
+	defer c.subsMu.Unlock()
+
+	ids := make([]OperationID, 0, len(c.subs))
+	for id := range c.subs {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	return ids
+}
+
+func sortIDs(ids []OperationID) {
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+}
+
+func (c *client) Wait(ctx context.Context) error {
+	c.subsMu.Lock()
+	ops := make([]*operation, 0, len(c.subs))
+	for _, op := range c.subs {
+		ops = append(ops, op)
+	}
+	c.subsMu.Unlock()
+
+	for _, op := range ops {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-op.ended:
+		}
+	}
+	return nil
+}
+
+// validate checks the request before it's sent to the server.
+func (c *client) validate(req *Request) error {
+	if !c.allowEmptyQuery && !req.isPersisted() && strings.TrimSpace(req.Query) == "" {
+		return ErrEmptyQuery
+	}
+	return checkVariables(c.getConn().codec, req.Variables)
+}
+
+// stop tells the server to stop the operation, unless it has already completed.
+func (c *client) stop(id OperationID) error {
+	conn := c.getConn()
+	if c.stopTimeout > 0 && conn.proto != SubprotocolGraphQLTransportWS {
+		return c.stopAndWait(conn, id)
+	}
+
+	if !c.unregister(id) {
+		// Already completed by the server
+		return nil
+	}
+
+	err := conn.write(context.TODO(), operationMessage{ID: id, Type: gqlStop})
+	if err != nil {
+		return ErrIO{
+			Msg: "failed to send stop message for: " + string(id),
+			Err: err,
+		}
+	}
+	return nil
+}
 
+// stopAndWait tells the server to stop the operation and then waits for it
+// to be completed by the server, until the stop timeout elapses.
+//
+func (c *client) stopAndWait(conn *Conn, id OperationID) error {
 	c.subsMu.Lock()
-	c.subs[oid] = respCh
+	op, ok := c.subs[id]
 	c.subsMu.Unlock()
+	if !ok {
+		// Already completed by the server
+		return nil
+	}
 
-	err := c.conn.write(ctx, msg)
+	err := conn.write(context.TODO(), operationMessage{ID: id, Type: gqlStop})
 	if err != nil {
-		return nil, ErrIO{
-			Msg: "failed to send query",
+		c.unregister(id)
+		return ErrIO{
+			Msg: "failed to send stop message for: " + string(id),
 			Err: err,
 		}
 	}
 
-	return &Subscription{
-		conn:   c.conn,
-		id:     oid,
-		respCh: respCh,
-		done:   make(chan struct{}, 1),
-	}, nil
+	timer := time.NewTimer(c.stopTimeout)
+	defer timer.Stop()
+
+	select {
+	case <-op.ended:
+	case <-timer.C:
+		// The server never confirmed, so fallback to forgetting it
+		c.unregister(id)
+	}
+	return nil
+}
+
+func (c *client) Ping(ctx context.Context) error {
+	if c.isClosed() {
+		return ErrClientClosed
+	}
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-c.ready:
+		// A terminated client was ready too, so its error takes precedence
+		if err := c.terminated(); err != nil {
+			return err
+		}
+	case <-c.done:
+		return c.err
+	}
+
+	conn := c.getConn()
+	if conn.proto != SubprotocolGraphQLTransportWS {
+		return ErrPingUnsupported
+	}
+
+	pong := make(chan struct{})
+	c.pingMu.Lock()
+	c.pingers = append(c.pingers, pong)
+	c.pingMu.Unlock()
+
+	err := conn.write(ctx, operationMessage{Type: gqlPing})
+	if err != nil {
+		return ErrIO{
+			Msg: "failed to send ping",
+			Err: err,
+		}
+	}
+
+	select {
+	case <-c.done:
+		return c.err
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-pong:
+		return nil
+	}
+}
+
+// pong responds to a ping from the server, echoing its payload.
+func (c *client) pong(conn *Conn, p payload) {
+	ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+	defer cancel()
+
+	conn.write(ctx, operationMessage{Type: gqlPong, Payload: p})
+}
+
+// notifyPingers notifies all in-flight pings that a pong was received.
+func (c *client) notifyPingers() {
+	c.pingMu.Lock()
+	defer c.pingMu.Unlock()
+
+	for _, pong := range c.pingers {
+		close(pong)
+	}
+	c.pingers = nil
+}
+
+func (c *client) AckPayload() json.RawMessage {
+	return c.getConn().AckPayload()
+}
+
+func (c *client) InvalidateCache() {
+	c.cache.invalidate()
+}
+
+func (c *client) Close() error {
+	c.closeOnce.Do(func() {
+		close(c.closed)
+
+		// Give the server a chance to close the connection in response
+		// to connection_terminate. Otherwise, the close handshake would
+		// race with the in-flight read of the read loop.
+		//
+		ctx, cancel := context.WithTimeout(context.Background(), defaultTimeout)
+		defer cancel()
+
+		conn := c.getConn()
+		err := conn.terminate(ctx)
+		if err == nil && conn.proto != SubprotocolGraphQLTransportWS {
+			select {
+			case <-c.done:
+			case <-ctx.Done():
+			}
+		}
+
+		c.closeErr = c.getConn().Close()
+
+		// Wait for the read loop to exit
+		<-c.done
+	})
+	return c.closeErr
+}
+
+func (c *client) isClosed() bool {
+	select {
+	case <-c.closed:
+		return true
+	default:
+		return false
+	}
 }
 
-func stopReq(conn *Conn, id opID, respCh <-chan qResp) {
+func stopReq(conn *Conn, id OperationID) {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	err := conn.write(ctx, operationMessage{ID: id, Type: gqlStop})
-	if err != nil {
+	conn.write(ctx, operationMessage{ID: id, Type: gqlStop})
+}
+
+// watchdog cancels the reads of a connection once no message has been
+// received, while there are in-flight operations, within its timeout.
+// A nil watchdog never cancels any reads.
+//
+type watchdog struct {
+	timeout time.Duration
+
+	mu     sync.Mutex
+	ops    int
+	gen    uint64
+	timer  *time.Timer
+	cancel context.CancelFunc
+	fired  bool
+}
+
+func newWatchdog(timeout time.Duration) *watchdog {
+	if timeout <= 0 {
+		return nil
+	}
+	return &watchdog{timeout: timeout}
+}
+
+// watch sets the func which cancels the reads of the current connection.
+func (w *watchdog) watch(cancel context.CancelFunc) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.cancel = cancel
+	w.fired = false
+	if w.ops > 0 {
+		w.arm()
+	}
+}
+
+// add adjusts the number of in-flight operations by delta.
+func (w *watchdog) add(delta int) {
+	if w == nil {
+		return
+	}
+
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.ops += delta
+	switch {
+	case w.ops == 0:
+		w.disarm()
+	case delta > 0 && w.ops == delta:
+		w.arm()
+	}
+}
+
+// received resets the timeout, if there are in-flight operations.
+func (w *watchdog) received() {
+	if w == nil {
 		return
 	}
 
-	// TODO: Should a local COMPLETE message be sent to processMessages?
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.ops > 0 {
+		w.arm()
+	}
+}
+
+// timedOut reports whether the reads were cancelled due to inactivity.
+func (w *watchdog) timedOut() bool {
+	if w == nil {
+		return false
+	}
 
-	// In case an in-flight DATA message was received it should be drained.
-	<-respCh
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.fired
+}
+
+// arm (re)starts the timer. The generation guards against a previous
+// timer, which fired concurrently, cancelling the reads.
+//
+func (w *watchdog) arm() {
+	w.disarm()
+
+	gen := w.gen
+	w.timer = time.AfterFunc(w.timeout, func() {
+		w.mu.Lock()
+		defer w.mu.Unlock()
+
+		if gen != w.gen || w.cancel == nil {
+			return
+		}
+		w.fired = true
+		w.cancel()
+	})
+}
+
+// disarm stops the timer.
+func (w *watchdog) disarm() {
+	w.gen++
+	if w.timer != nil {
+		w.timer.Stop()
+		w.timer = nil
+	}
 }
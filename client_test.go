@@ -7,16 +7,20 @@ import (
 	"fmt"
 	"net/http"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
+	"github.com/zaba505/gws/backoff"
 	"nhooyr.io/websocket"
 )
 
 func newTestServer(f func(*Conn)) *httptest.Server {
 	opts := &websocket.AcceptOptions{
-		Subprotocols: []string{"graphql-ws"},
+		Subprotocols: []string{"graphql-ws", "graphql-transport-ws"},
 	}
 
 	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
@@ -25,6 +29,142 @@ func newTestServer(f func(*Conn)) *httptest.Server {
 	}))
 }
 
+// recordingServer is a test server which acknowledges the connection and
+// records every message received from the client, in order, so tests can
+// assert on what the client sent, instead of reading raw frames.
+type recordingServer struct {
+	*httptest.Server
+
+	msgs chan operationMessage
+}
+
+// newRecordingServer returns a recordingServer, which calls respond, if
+// non-nil, with every message received other than connection_init and
+// connection_terminate. At most 100 messages are buffered, after which
+// the server stops reading until they're consumed by expect.
+func newRecordingServer(respond func(*Conn, operationMessage)) *recordingServer {
+	rs := &recordingServer{msgs: make(chan operationMessage, 100)}
+	rs.Server = newTestServer(func(conn *Conn) {
+		ctx := context.Background()
+		for {
+			b, err := conn.read(ctx)
+			if err != nil {
+				return
+			}
+
+			var msg operationMessage
+			if msg.UnmarshalJSON(b) != nil && msg.Type == "" {
+				return
+			}
+			rs.msgs <- msg
+
+			switch msg.Type {
+			case gqlConnectionInit:
+				conn.write(ctx, operationMessage{Type: gqlConnectionAck})
+			case gqlConnectionTerminate:
+				conn.wc.Close(websocket.StatusNormalClosure, "terminated")
+				return
+			default:
+				if respond != nil {
+					respond(conn, msg)
+				}
+			}
+		}
+	})
+	return rs
+}
+
+// expect asserts that the next messages received from the client are
+// of the given types, in order, and returns them.
+func (rs *recordingServer) expect(t *testing.T, types ...reqType) []operationMessage {
+	t.Helper()
+
+	msgs := make([]operationMessage, 0, len(types))
+	for _, typ := range types {
+		select {
+		case msg := <-rs.msgs:
+			if msg.Type != typ {
+				t.Logf("expected message: %s, but got: %s", typ, msg.Type)
+				t.Fail()
+				return msgs
+			}
+			msgs = append(msgs, msg)
+		case <-time.After(2 * time.Second):
+			t.Logf("expected message: %s, but got none", typ)
+			t.Fail()
+			return msgs
+		}
+	}
+	return msgs
+}
+
+func TestClient_WireMessages(t *testing.T) {
+	t.Run("Query", func(subT *testing.T) {
+		srv := newRecordingServer(func(conn *Conn, msg operationMessage) {
+			conn.write(context.Background(), operationMessage{ID: msg.ID, Type: gqlData, Payload: &Response{Data: []byte(`{}`)}})
+			conn.write(context.Background(), operationMessage{ID: msg.ID, Type: gqlComplete})
+		})
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		client := NewClient(conn)
+		_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		client.Close()
+
+		msgs := srv.expect(subT, gqlConnectionInit, gqlStart, gqlConnectionTerminate)
+		if len(msgs) == 3 && msgs[1].ID == "" {
+			subT.Log("expected the start to have an id")
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("CancelledSubscription", func(subT *testing.T) {
+		srv := newRecordingServer(nil)
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+
+		client := NewClient(conn)
+		_, err = client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		msgs := srv.expect(subT, gqlConnectionInit, gqlStart)
+		cancel()
+		msgs = append(msgs, srv.expect(subT, gqlStop)...)
+		client.Close()
+		srv.expect(subT, gqlConnectionTerminate)
+
+		if len(msgs) == 3 && msgs[1].ID != msgs[2].ID {
+			subT.Logf("expected the stop for: %s, but got: %s", msgs[1].ID, msgs[2].ID)
+			subT.Fail()
+			return
+		}
+	})
+}
+
 func TestCloseDuringInFlightQuery(t *testing.T) {
 	var conn *Conn
 	var err error
@@ -45,8 +185,8 @@ func TestCloseDuringInFlightQuery(t *testing.T) {
 
 	client := NewClient(conn)
 	resp, err := client.Query(ctx, &Request{Query: "{ hello { world } }"})
-	if err == nil {
-		t.Log("expected an error")
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Logf("expected: %v, got: %v", ErrConnectionClosed, err)
 		t.Fail()
 		return
 	}
@@ -58,6 +198,148 @@ func TestCloseDuringInFlightQuery(t *testing.T) {
 	}
 }
 
+func TestServerCloseDuringInFlightQuery(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+		conn.read(context.Background())
+		conn.wc.Close(websocket.StatusInternalError, "internal error")
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := NewClient(conn)
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Logf("expected: %v, got: %v", ErrConnectionClosed, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestCloseError(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+		conn.read(context.Background())
+		conn.wc.Close(websocket.StatusCode(CloseUnauthorized), "Unauthorized")
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := NewClient(conn)
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+
+	var cerr *CloseError
+	if !errors.As(err, &cerr) {
+		t.Logf("wrong error: %v", err)
+		t.Fail()
+		return
+	}
+	if cerr.Code() != CloseUnauthorized || cerr.Reason() != "Unauthorized" {
+		t.Logf("unexpected close code and reason: %d %s", cerr.Code(), cerr.Reason())
+		t.Fail()
+		return
+	}
+	if !errors.Is(err, ErrConnectionClosed) {
+		t.Logf("expected error to match: %v", ErrConnectionClosed)
+		t.Fail()
+		return
+	}
+}
+
+func TestCloseError_Reason(t *testing.T) {
+	const reason = "unauthorized: token expired"
+
+	testCases := []struct {
+		Name string
+		Do   func(context.Context, Client, <-chan error) error
+	}{
+		{
+			Name: "Query",
+			Do: func(ctx context.Context, client Client, _ <-chan error) error {
+				_, err := client.Query(ctx, &Request{Query: "{ hello { world } }"})
+				return err
+			},
+		},
+		{
+			// Subscriptions end with ErrUnsubscribed, so the
+			// reason is only reported to the close handler.
+			Name: "Subscribe",
+			Do: func(ctx context.Context, client Client, closeErrs <-chan error) error {
+				sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+				if err != nil {
+					return err
+				}
+				_, err = sub.Recv(ctx)
+				if err != ErrUnsubscribed {
+					return fmt.Errorf("expected: %s, but got: %v", ErrUnsubscribed, err)
+				}
+				return <-closeErrs
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := newTestServer(func(conn *Conn) {
+				conn.read(context.Background())
+				conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+				conn.read(context.Background())
+				conn.wc.Close(websocket.StatusPolicyViolation, reason)
+			})
+			defer srv.Close()
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			closeErrs := make(chan error, 1)
+			client := NewClient(conn, WithCloseHandler(func(err error) {
+				closeErrs <- err
+			}))
+
+			err = testCase.Do(ctx, client, closeErrs)
+
+			var cerr *CloseError
+			if !errors.As(err, &cerr) || cerr.Reason() != reason || cerr.Code() != CloseCode(websocket.StatusPolicyViolation) {
+				subT.Logf("wrong error: %v", err)
+				subT.Fail()
+				return
+			}
+			if !strings.Contains(err.Error(), reason) {
+				subT.Logf("expected the error to include the close reason: %v", err)
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
 func TestSubscription_CompleteDuringInFlightRecv(t *testing.T) {
 	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
 		return s.Close()
@@ -132,6 +414,201 @@ func TestSubscription_UnsubscribeDuringInFlightRecv(t *testing.T) {
 	}
 }
 
+func TestWithSubscriptionBuffer(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Policy OverflowPolicy
+		Recv   []string
+		Err    error
+	}{
+		{Name: "DropOldest", Policy: DropOldest, Recv: []string{"4", "5"}},
+		{Name: "DropNewest", Policy: DropNewest, Recv: []string{"1", "2"}},
+		{Name: "CloseOnOverflow", Policy: CloseOnOverflow, Recv: []string{"1", "2"}, Err: ErrSubscriptionOverflow},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := newRecordingServer(func(conn *Conn, msg operationMessage) {
+				req, ok := msg.Payload.(*Request)
+				if msg.Type != gqlStart || !ok {
+					return
+				}
+
+				ctx := context.Background()
+				if strings.HasPrefix(req.Query, "subscription") {
+					for i := 1; i <= 5; i++ {
+						conn.write(ctx, operationMessage{ID: msg.ID, Type: gqlData, Payload: &Response{Data: []byte(strconv.Itoa(i))}})
+					}
+					return
+				}
+				conn.write(ctx, operationMessage{ID: msg.ID, Type: gqlData, Payload: &Response{Data: []byte(`{}`)}})
+				conn.write(ctx, operationMessage{ID: msg.ID, Type: gqlComplete})
+			})
+			defer srv.Close()
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			client := NewClient(conn, WithSubscriptionBuffer(2, testCase.Policy))
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			defer sub.Unsubscribe()
+
+			// Responses are processed in order, so the query only completes
+			// if the unreceived subscription responses didn't stall it.
+			//
+			_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			for _, want := range testCase.Recv {
+				resp, err := sub.Recv(ctx)
+				if err != nil {
+					subT.Error(err)
+					return
+				}
+				if string(resp.Data) != want {
+					subT.Logf("expected data: %s, but got: %s", want, string(resp.Data))
+					subT.Fail()
+					return
+				}
+			}
+
+			if testCase.Err == nil {
+				return
+			}
+
+			_, err = sub.Recv(ctx)
+			if err != testCase.Err {
+				subT.Logf("expected: %v, but got: %v", testCase.Err, err)
+				subT.Fail()
+				return
+			}
+			// The stop may be sent before, or after, the query is started
+			msgs := srv.expect(subT, gqlConnectionInit, gqlStart)
+			if len(msgs) != 2 {
+				return
+			}
+			for i := 0; i < 2; i++ {
+				select {
+				case msg := <-srv.msgs:
+					if msg.Type == gqlStop && msg.ID == msgs[1].ID {
+						return
+					}
+				case <-ctx.Done():
+				}
+			}
+			subT.Log("expected the subscription to be stopped")
+			subT.Fail()
+		})
+	}
+}
+
+func TestWithStopTimeout(t *testing.T) {
+	t.Run("Confirmed", func(subT *testing.T) {
+		srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+			<-s.Context().Done()
+			return nil
+		})))
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn, WithStopTimeout(5*time.Second))
+		defer client.Close()
+
+		sub, err := client.Subscribe(context.Background(), &Request{Query: "subscription { hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		start := time.Now()
+		err = sub.Unsubscribe()
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		if d := time.Since(start); d > 2*time.Second {
+			subT.Logf("expected the server to confirm the stop, but waited: %s", d)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Unconfirmed", func(subT *testing.T) {
+		srv := newTestServer(func(conn *Conn) {
+			conn.read(context.Background())
+			conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+			// Ignore everything else, including the stop
+			for {
+				b, err := conn.read(context.Background())
+				if err != nil {
+					return
+				}
+
+				var msg operationMessage
+				if msg.UnmarshalJSON(b) == nil && msg.Type == gqlConnectionTerminate {
+					conn.wc.Close(websocket.StatusNormalClosure, "terminated")
+					return
+				}
+			}
+		})
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn, WithStopTimeout(100*time.Millisecond))
+		defer client.Close()
+
+		sub, err := client.Subscribe(context.Background(), &Request{Query: "subscription { hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		start := time.Now()
+		err = sub.Unsubscribe()
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		if d := time.Since(start); d < 100*time.Millisecond {
+			subT.Logf("expected to wait for the stop timeout, but only waited: %s", d)
+			subT.Fail()
+			return
+		}
+
+		if ops := client.ActiveOperations(); len(ops) != 0 {
+			subT.Logf("expected no active operations but got: %v", ops)
+			subT.Fail()
+			return
+		}
+	})
+}
+
 func TestSubscription_ConcurrentRecv(t *testing.T) {
 	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
 		defer s.Close()
@@ -222,8 +699,22 @@ func TestSubscription_ConcurrentRecv(t *testing.T) {
 	wg.Wait()
 }
 
-func TestHandleServerError(t *testing.T) {
-	srv := httptest.NewServer(NewHandler(HandlerFunc(errHandler)))
+func TestSubscription_RecvUntilComplete(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		if req.Query != "subscription { hello { world } }" {
+			return s.Send(context.TODO(), &Response{Data: []byte(`{"hello":{"world":"query"}}`)})
+		}
+
+		for i := 0; i < 3; i++ {
+			err := s.Send(context.TODO(), &Response{Data: []byte(`{"hello":{"world":"sub"}}`)})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})))
 	defer srv.Close()
 
 	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
@@ -233,29 +724,1685 @@ func TestHandleServerError(t *testing.T) {
 	}
 	defer conn.Close()
 
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
 	client := NewClient(conn)
-	_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
-	if err == nil {
-		t.Log("expected an error")
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+	if err != nil {
+		t.Log("unexpected error", err)
 		t.Fail()
 		return
 	}
+	defer sub.Unsubscribe()
 
-	var serr *ServerError
-	if !errors.As(err, &serr) {
-		t.Log("wrong err type:", err)
-		t.Fail()
-		return
-	}
-	t.Log(serr)
-}
+	var wg sync.WaitGroup
+	wg.Add(1)
 
-func TestContextCancel(t *testing.T) {
+	go func() {
+		defer wg.Done()
+
+		for i := 0; i < 3; i++ {
+			resp, err := sub.Recv(ctx)
+			if err != nil {
+				t.Log("unexpected error", err)
+				t.Fail()
+				return
+			}
+			if string(resp.Data) != `{"hello":{"world":"sub"}}` {
+				t.Logf("unexpected subscription response: %s", string(resp.Data))
+				t.Fail()
+				return
+			}
+		}
+
+		_, err := sub.Recv(ctx)
+		if err != ErrUnsubscribed {
+			t.Logf("expected: %s, but got: %s", ErrUnsubscribed, err)
+			t.Fail()
+			return
+		}
+	}()
+
+	resp, err := client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if err != nil {
+		t.Log("unexpected error", err)
+		t.Fail()
+		return
+	}
+	if string(resp.Data) != `{"hello":{"world":"query"}}` {
+		t.Logf("unexpected query response: %s", string(resp.Data))
+		t.Fail()
+		return
+	}
+
+	wg.Wait()
+}
+
+func TestSubscription_Responses(t *testing.T) {
+	srv := newRecordingServer(func(conn *Conn, msg operationMessage) {
+		if msg.Type != gqlStart {
+			return
+		}
+
+		ctx := context.Background()
+		for i := 1; i <= 3; i++ {
+			conn.write(ctx, operationMessage{ID: msg.ID, Type: gqlData, Payload: &Response{Data: []byte(strconv.Itoa(i))}})
+		}
+		if msg.Payload.(*Request).OperationName == "Complete" {
+			conn.write(ctx, operationMessage{ID: msg.ID, Type: gqlComplete})
+		}
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("Completed", func(subT *testing.T) {
+		sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }", OperationName: "Complete"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		var data []string
+		sub.Responses(ctx)(func(resp *Response, err error) bool {
+			if err != nil {
+				subT.Error(err)
+				return false
+			}
+			data = append(data, string(resp.Data))
+			return true
+		})
+
+		if strings.Join(data, ",") != "1,2,3" {
+			subT.Logf("expected all responses, but got: %v", data)
+			subT.Fail()
+			return
+		}
+		srv.expect(subT, gqlConnectionInit, gqlStart)
+	})
+
+	t.Run("Break", func(subT *testing.T) {
+		sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		var data []string
+		sub.Responses(ctx)(func(resp *Response, err error) bool {
+			data = append(data, string(resp.Data))
+			return len(data) < 2
+		})
+
+		if strings.Join(data, ",") != "1,2" {
+			subT.Logf("expected the first two responses, but got: %v", data)
+			subT.Fail()
+			return
+		}
+
+		msgs := srv.expect(subT, gqlStart, gqlStop)
+		if len(msgs) == 2 && msgs[0].ID != msgs[1].ID {
+			subT.Logf("expected the stop for: %s, but got: %s", msgs[0].ID, msgs[1].ID)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestSubscription_InterleavedErrors(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		ctx := context.Background()
+
+		conn.read(ctx)
+		conn.write(ctx, operationMessage{Type: gqlConnectionAck})
+
+		b, err := conn.read(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		var start operationMessage
+		err = start.UnmarshalJSON(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		msgs := []operationMessage{
+			{Type: gqlData, Payload: &Response{Data: []byte(`{"hello":1}`)}},
+			{Type: gqlData, Payload: &Response{Errors: []json.RawMessage{[]byte(`{"message":"partial"}`)}}},
+			{Type: gqlError, Payload: &ServerError{Msg: "resolver failed"}},
+			{Type: gqlData, Payload: &Response{Data: []byte(`{"hello":2}`)}},
+			{Type: gqlComplete},
+		}
+		for _, msg := range msgs {
+			msg.ID = start.ID
+			conn.write(ctx, msg)
+		}
+
+		<-conn.wc.CloseRead(ctx).Done()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := sub.Recv(ctx)
+	if err != nil || string(resp.Data) != `{"hello":1}` {
+		t.Logf("unexpected result: %v, %v", resp, err)
+		t.Fail()
+		return
+	}
+
+	resp, err = sub.Recv(ctx)
+	if err != nil || len(resp.Errors) != 1 {
+		t.Logf("expected a response with errors, but got: %v, %v", resp, err)
+		t.Fail()
+		return
+	}
+
+	_, err = sub.Recv(ctx)
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Logf("expected a server error, but got: %v", err)
+		t.Fail()
+		return
+	}
+
+	resp, err = sub.Recv(ctx)
+	if err != nil || string(resp.Data) != `{"hello":2}` {
+		t.Logf("expected the subscription to continue, but got: %v, %v", resp, err)
+		t.Fail()
+		return
+	}
+
+	_, err = sub.Recv(ctx)
+	if err != ErrUnsubscribed {
+		t.Logf("expected: %s, but got: %v", ErrUnsubscribed, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestSubscription_Close(t *testing.T) {
+	stopped := make(chan struct{})
+
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		if req.Query != "subscription { hello { world } }" {
+			return testHandler(s, req)
+		}
+
+		for {
+			err := s.Send(context.TODO(), &Response{Data: []byte(`{"hello":{"world":"sub"}}`)})
+			if err == ErrStreamClosed {
+				close(stopped)
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := NewClient(conn)
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	_, err = sub.Recv(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sub.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = sub.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	select {
+	case <-stopped:
+	case <-ctx.Done():
+		t.Log("server never received stop message")
+		t.Fail()
+		return
+	}
+
+	_, err = sub.Recv(ctx)
+	if err != ErrUnsubscribed {
+		t.Logf("expected: %s, but got: %s", ErrUnsubscribed, err)
+		t.Fail()
+		return
+	}
+
+	// The connection should still be usable
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestClient_Close(t *testing.T) {
+	received := make(chan struct{})
+	done := make(chan struct{})
+	defer close(done)
+
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		close(received)
+		<-done
+		return s.Close()
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client := NewClient(conn)
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := client.Query(ctx, &Request{Query: "{ hello { world } }"})
+		errCh <- err
+	}()
+
+	<-received
+	err = client.Close()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = <-errCh
+	if err != ErrClientClosed {
+		t.Logf("expected: %s, but got: %v", ErrClientClosed, err)
+		t.Fail()
+		return
+	}
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if err != ErrClientClosed {
+		t.Logf("expected: %s, but got: %v", ErrClientClosed, err)
+		t.Fail()
+		return
+	}
+
+	_, err = client.Subscribe(ctx, &Request{Query: "{ hello { world } }"})
+	if err != ErrClientClosed {
+		t.Logf("expected: %s, but got: %v", ErrClientClosed, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestClient_CloseWithUnreadSubscription(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		for s.Context().Err() == nil {
+			err := s.Send(context.TODO(), &Response{Data: []byte(`{"hello":{"world":"sub"}}`)})
+			if err != nil {
+				return nil
+			}
+		}
+		return nil
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+
+	sub, err := client.Subscribe(context.Background(), &Request{Query: "subscription { hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Let results back up, since nobody is receiving them
+	time.Sleep(50 * time.Millisecond)
+
+	closed := make(chan error, 1)
+	go func() {
+		closed <- client.Close()
+	}()
+
+	select {
+	case <-closed:
+	case <-time.After(10 * time.Second):
+		t.Log("close never returned")
+		t.Fail()
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+
+	for {
+		_, err = sub.Recv(ctx)
+		if err != nil {
+			break
+		}
+	}
+	if err != ErrUnsubscribed {
+		t.Logf("expected: %s, but got: %v", ErrUnsubscribed, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestSubscription_ErrorEndsOperation(t *testing.T) {
+	h := NewHandler(HandlerFunc(errHandler)).(*handler)
+	h.wcOptions.Subprotocols = []string{SubprotocolGraphQLTransportWS}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c := NewClient(conn)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	sub, err := c.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, err := sub.Recv(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(resp.Errors) != 1 {
+		t.Logf("expected a single error but got: %d", len(resp.Errors))
+		t.Fail()
+		return
+	}
+
+	_, err = sub.Recv(ctx)
+	if err != ErrUnsubscribed {
+		t.Logf("expected: %s, but got: %v", ErrUnsubscribed, err)
+		t.Fail()
+		return
+	}
+
+	cl := c.(*client)
+	cl.subsMu.Lock()
+	n := len(cl.subs)
+	cl.subsMu.Unlock()
+	if n != 0 {
+		t.Logf("expected no tracked operations but got: %d", n)
+		t.Fail()
+		return
+	}
+}
+
+func TestOperationErrorKeepsConnection(t *testing.T) {
+	h := NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		if strings.Contains(req.Query, "fail") {
+			return errHandler(s, req)
+		}
+		return testHandler(s, req)
+	})).(*handler)
+	h.wcOptions.Subprotocols = []string{SubprotocolGraphQLTransportWS}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c := NewClient(conn)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp, err := c.Query(ctx, &Request{Query: "{ fail }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if len(resp.Errors) != 1 {
+		t.Logf("expected a single error but got: %d", len(resp.Errors))
+		t.Fail()
+		return
+	}
+
+	resp, err = c.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if err != nil {
+		t.Logf("expected the connection to remain usable but got: %v", err)
+		t.Fail()
+		return
+	}
+	if len(resp.Errors) != 0 || len(resp.Data) == 0 {
+		t.Logf("unexpected response: %#v", resp)
+		t.Fail()
+		return
+	}
+}
+
+func TestHandleServerError(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(errHandler)))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	client := NewClient(conn)
+	_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+	if err == nil {
+		t.Log("expected an error")
+		t.Fail()
+		return
+	}
+
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Log("wrong err type:", err)
+		t.Fail()
+		return
+	}
+	t.Log(serr)
+}
+
+func TestContextCancel(t *testing.T) {
 	ctx, cancel := context.WithCancel(context.Background())
 
-	srv := httptest.NewServer(NewHandler(HandlerFunc(func(_ *Stream, req *Request) error {
-		cancel()
-		return nil
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(_ *Stream, req *Request) error {
+		cancel()
+		return nil
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	client := NewClient(conn)
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if err == nil {
+		t.Log("expected an error")
+		t.Fail()
+		return
+	}
+}
+
+func TestContextCancel_SendsStop(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Do   func(context.Context, Client) error
+	}{
+		{
+			Name: "Query",
+			Do: func(ctx context.Context, c Client) error {
+				_, err := c.Query(ctx, &Request{Query: "{ hello }"})
+				if err != context.Canceled {
+					return fmt.Errorf("expected: %s, but got: %v", context.Canceled, err)
+				}
+				return nil
+			},
+		},
+		{
+			Name: "Subscribe",
+			Do: func(ctx context.Context, c Client) error {
+				sub, err := c.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+				if err != nil {
+					return err
+				}
+
+				_, err = sub.Recv(context.Background())
+				if err != ErrUnsubscribed {
+					return fmt.Errorf("expected: %s, but got: %v", ErrUnsubscribed, err)
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			started := make(chan struct{})
+			stopped := make(chan OperationID, 1)
+			srv := newTestServer(func(conn *Conn) {
+				defer close(stopped)
+
+				ctx := context.Background()
+				conn.read(ctx)
+				conn.write(ctx, operationMessage{Type: gqlConnectionAck})
+
+				var start operationMessage
+				b, err := conn.read(ctx)
+				if err != nil || start.UnmarshalJSON(b) != nil {
+					return
+				}
+				close(started)
+
+				var stop operationMessage
+				b, err = conn.read(ctx)
+				if err != nil || stop.UnmarshalJSON(b) != nil {
+					return
+				}
+				if stop.Type == gqlStop && stop.ID == start.ID {
+					stopped <- stop.ID
+				}
+				conn.wc.Close(websocket.StatusNormalClosure, "done")
+			})
+			defer srv.Close()
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			client := NewClient(conn)
+			defer client.Close()
+
+			ctx, cancel := context.WithCancel(context.Background())
+			go func() {
+				<-started
+				cancel()
+			}()
+
+			err = testCase.Do(ctx, client)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			select {
+			case _, ok := <-stopped:
+				if !ok {
+					subT.Log("expected the server to receive a stop")
+					subT.Fail()
+					return
+				}
+			case <-time.After(2 * time.Second):
+				subT.Log("server never received a stop")
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestFailedIO(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		conn.wc.CloseRead(context.Background())
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Close()
+
+	client := NewClient(conn)
+
+	_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+
+	var ioErr ErrIO
+	if !errors.As(err, &ioErr) {
+		t.Logf("wrong error: %s", err)
+		t.Fail()
+		return
+	}
+	t.Log(ioErr)
+}
+
+func TestUnexpectedAckMessage(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		conn.wc.CloseRead(context.Background())
+
+		conn.write(context.Background(), operationMessage{ID: "1", Type: gqlData})
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if err == nil {
+		t.Log("expected error")
+		t.Fail()
+		return
+	}
+
+	var msgErr ErrUnexpectedMessage
+	if !errors.As(err, &msgErr) {
+		t.Logf("wrong error: %s", err)
+		t.Fail()
+		return
+	}
+	t.Log(msgErr)
+}
+
+func TestConnectionError(t *testing.T) {
+	const connErrMsg = `{"type":"connection_error","payload":{"message":"unauthorized"}}`
+
+	testCases := []struct {
+		Name    string
+		Handler func(*Conn)
+	}{
+		{
+			Name: "DuringHandshake",
+			Handler: func(conn *Conn) {
+				conn.wc.CloseRead(context.Background())
+
+				conn.wc.Write(context.Background(), websocket.MessageBinary, []byte(connErrMsg))
+			},
+		},
+		{
+			Name: "DuringQuery",
+			Handler: func(conn *Conn) {
+				conn.read(context.Background())
+				conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+				conn.read(context.Background())
+				conn.wc.CloseRead(context.Background())
+				conn.wc.Write(context.Background(), websocket.MessageBinary, []byte(connErrMsg))
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := newTestServer(testCase.Handler)
+			defer srv.Close()
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			client := NewClient(conn)
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+
+			var cerr *ConnectionError
+			if !errors.As(err, &cerr) {
+				subT.Logf("wrong error: %v", err)
+				subT.Fail()
+				return
+			}
+			if string(cerr.Payload) != `{"message":"unauthorized"}` {
+				subT.Logf("unexpected payload: %s", string(cerr.Payload))
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestWithKeepAliveTimeout(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+		// Keep the connection alive for a bit
+		for i := 0; i < 3; i++ {
+			time.Sleep(100 * time.Millisecond)
+			conn.write(context.Background(), operationMessage{Type: gqlConnectionKeepAlive})
+		}
+
+		// and then simply stall
+		conn.read(context.Background())
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn, WithKeepAliveTimeout(200*time.Millisecond))
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	start := time.Now()
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if err != ErrKeepAliveTimeout {
+		t.Logf("expected: %s, but got: %v", ErrKeepAliveTimeout, err)
+		t.Fail()
+		return
+	}
+
+	if time.Since(start) < 300*time.Millisecond {
+		t.Log("connection was considered dead while keep alives were being received")
+		t.Fail()
+		return
+	}
+}
+
+func TestWithInactivityTimeout(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		ctx := context.Background()
+
+		conn.read(ctx)
+		conn.write(ctx, operationMessage{Type: gqlConnectionAck})
+
+		// Respond to the first query
+		var start operationMessage
+		b, err := conn.read(ctx)
+		if err != nil || start.UnmarshalJSON(b) != nil {
+			return
+		}
+		conn.write(ctx, operationMessage{ID: start.ID, Type: gqlData, Payload: &Response{Data: []byte(`{"hello":"world"}`)}})
+		conn.write(ctx, operationMessage{ID: start.ID, Type: gqlComplete})
+
+		// and then simply stall
+		conn.read(ctx)
+		conn.read(ctx)
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn, WithInactivityTimeout(100*time.Millisecond))
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	// An idle connection isn't considered dead
+	time.Sleep(300 * time.Millisecond)
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+	if err != nil {
+		t.Logf("expected the idle connection to remain usable, but got: %v", err)
+		t.Fail()
+		return
+	}
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+	if err != ErrInactivityTimeout {
+		t.Logf("expected: %s, but got: %v", ErrInactivityTimeout, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestWithQueryTimeout(t *testing.T) {
+	stopped := make(chan reqType, 1)
+	srv := newTestServer(func(conn *Conn) {
+		defer conn.wc.CloseRead(context.Background())
+
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+		// Never respond to the query
+		conn.read(context.Background())
+
+		b, _ := conn.read(context.Background())
+		var msg operationMessage
+		msg.UnmarshalJSON(b)
+		stopped <- msg.Type
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn, WithQueryTimeout(50*time.Millisecond))
+	defer client.Close()
+
+	_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+	if err != ErrQueryTimeout {
+		t.Logf("expected: %s, but got: %v", ErrQueryTimeout, err)
+		t.Fail()
+		return
+	}
+
+	select {
+	case typ := <-stopped:
+		if typ != gqlStop {
+			t.Logf("expected stop message but got: %s", typ)
+			t.Fail()
+			return
+		}
+	case <-time.After(2 * time.Second):
+		t.Log("query was never stopped")
+		t.Fail()
+		return
+	}
+}
+
+func TestWithCloseHandler(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Handler func(*Conn)
+		Close   bool
+		Check   func(error) bool
+	}{
+		{
+			Name: "Close",
+			Handler: func(conn *Conn) {
+				conn.read(context.Background())
+				conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+				// Wait for connection_terminate
+				conn.read(context.Background())
+				conn.wc.Close(websocket.StatusNormalClosure, "closed")
+			},
+			Close: true,
+			Check: func(err error) bool { return err == nil },
+		},
+		{
+			Name: "PeerClosed",
+			Handler: func(conn *Conn) {
+				conn.read(context.Background())
+				conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+				conn.wc.Close(websocket.StatusGoingAway, "shutting down")
+			},
+			Check: func(err error) bool {
+				var ioErr ErrIO
+				return errors.As(err, &ioErr)
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := newTestServer(testCase.Handler)
+			defer srv.Close()
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			var calls int32
+			errCh := make(chan error, 1)
+			client := NewClient(conn, WithCloseHandler(func(err error) {
+				atomic.AddInt32(&calls, 1)
+				errCh <- err
+			}))
+
+			if testCase.Close {
+				client.Close()
+			}
+
+			select {
+			case err = <-errCh:
+			case <-time.After(2 * time.Second):
+				subT.Log("close handler was never called")
+				subT.Fail()
+				return
+			}
+			client.Close()
+
+			if !testCase.Check(err) {
+				subT.Logf("unexpected error: %v", err)
+				subT.Fail()
+				return
+			}
+			if n := atomic.LoadInt32(&calls); n != 1 {
+				subT.Logf("expected close handler to be called once but was called: %d", n)
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestClient_Mutation(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+		return s.Send(context.Background(), &Response{Data: json.RawMessage(`{"setHello":"world"}`)})
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Mutation(ctx, &Request{Query: `mutation { setHello(to: "world") }`})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(resp.Data) != `{"setHello":"world"}` {
+		t.Log("unexpected response:", string(resp.Data))
+		t.Fail()
+		return
+	}
+}
+
+func TestClient_QueryBatch(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		if req.Query == "{ fail }" {
+			return errors.New("failed")
+		}
+		defer s.Close()
+		return s.Send(context.Background(), &Response{Data: json.RawMessage(strconv.Quote(req.Query))})
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	reqs := []*Request{
+		{Query: "{ a }"},
+		{Query: "{ fail }"},
+		{Query: "{ b }"},
+	}
+	resps, errs := client.QueryBatch(ctx, reqs)
+	if len(resps) != len(reqs) || len(errs) != len(reqs) {
+		t.Logf("expected %d results, got: %d responses and %d errors", len(reqs), len(resps), len(errs))
+		t.Fail()
+		return
+	}
+
+	for i, req := range reqs {
+		if req.Query == "{ fail }" {
+			var serr *ServerError
+			if !errors.As(errs[i], &serr) {
+				t.Logf("expected server error for slot %d, got: %v", i, errs[i])
+				t.Fail()
+			}
+			continue
+		}
+
+		if errs[i] != nil {
+			t.Logf("unexpected error for slot %d: %v", i, errs[i])
+			t.Fail()
+			continue
+		}
+		if string(resps[i].Data) != strconv.Quote(req.Query) {
+			t.Logf("expected response for %s in slot %d, got: %s", req.Query, i, resps[i].Data)
+			t.Fail()
+		}
+	}
+}
+
+func TestClient_Wait(t *testing.T) {
+	started := make(chan struct{})
+	release := make(chan struct{})
+
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+		close(started)
+		<-release
+		return s.Send(context.Background(), &Response{Data: json.RawMessage(`{"hello":"world"}`)})
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	queryErr := make(chan error, 1)
+	go func() {
+		_, err := client.Query(ctx, &Request{Query: "{ hello }"})
+		queryErr <- err
+	}()
+	<-started
+
+	wctx, wcancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer wcancel()
+
+	err = client.Wait(wctx)
+	if err != context.DeadlineExceeded {
+		t.Logf("expected: %v, got: %v", context.DeadlineExceeded, err)
+		t.Fail()
+		return
+	}
+
+	close(release)
+	err = client.Wait(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = <-queryErr
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestIncrementalDelivery(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		resps := []*Response{
+			{Data: []byte(`{"hero":{"name":"R2-D2"}}`), HasNext: true},
+			{
+				Incremental: []json.RawMessage{[]byte(`{"data":{"friends":[]},"path":["hero"]}`)},
+				HasNext:     true,
+			},
+			{
+				Errors:      []json.RawMessage{[]byte(`{"message":"partial failure"}`)},
+				Incremental: []json.RawMessage{[]byte(`{"items":["Luke"],"path":["hero","friends",0]}`)},
+			},
+		}
+		for _, resp := range resps {
+			err := s.Send(context.TODO(), resp)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Query(ctx, &Request{Query: "{ hero { name ... @defer { friends @stream { name } } } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if string(resp.Data) != `{"hero":{"name":"R2-D2"}}` {
+		t.Logf("unexpected initial data: %s", string(resp.Data))
+		t.Fail()
+		return
+	}
+	if resp.HasNext {
+		t.Log("expected the final result to have been received")
+		t.Fail()
+		return
+	}
+	if len(resp.Incremental) != 2 || len(resp.Errors) != 1 {
+		t.Logf("expected all incremental results and errors, but got: %s, %s", resp.Incremental, resp.Errors)
+		t.Fail()
+		return
+	}
+	if string(resp.Incremental[1]) != `{"items":["Luke"],"path":["hero","friends",0]}` {
+		t.Logf("incremental results are out of order: %s", resp.Incremental)
+		t.Fail()
+		return
+	}
+}
+
+func TestIncrementalDelivery_WithoutComplete(t *testing.T) {
+	srv := newRecordingServer(func(conn *Conn, msg operationMessage) {
+		if msg.Type != gqlStart {
+			return
+		}
+
+		resps := []*Response{
+			{Data: []byte(`{"hero":{"name":"R2-D2"}}`), HasNext: true},
+			{Incremental: []json.RawMessage{[]byte(`{"data":{"friends":[]},"path":["hero"]}`)}},
+		}
+		for _, resp := range resps {
+			conn.write(context.Background(), operationMessage{ID: msg.ID, Type: gqlData, Payload: resp})
+		}
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	c := NewClient(conn)
+	defer c.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp, err := c.Query(ctx, &Request{Query: "{ hero { name ... @defer { friends { name } } } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if resp.HasNext || len(resp.Incremental) != 1 {
+		t.Logf("expected the final result to have been received, but got: %#v", resp)
+		t.Fail()
+		return
+	}
+
+	// The query is completed right after its final result is delivered
+	cl := c.(*client)
+	for {
+		cl.subsMu.Lock()
+		n := len(cl.subs)
+		cl.subsMu.Unlock()
+		if n == 0 {
+			break
+		}
+
+		select {
+		case <-ctx.Done():
+			t.Logf("expected no tracked operations but got: %d", n)
+			t.Fail()
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+func TestInvalidVariables(t *testing.T) {
+	srv := newRecordingServer(func(conn *Conn, msg operationMessage) {
+		conn.write(context.Background(), operationMessage{ID: msg.ID, Type: gqlData, Payload: &Response{Data: []byte(`{}`)}})
+		conn.write(context.Background(), operationMessage{ID: msg.ID, Type: gqlComplete})
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	invalid := &Request{
+		Query:     "query ($ch: Int) { hello }",
+		Variables: map[string]interface{}{"ch": make(chan int)},
+	}
+	_, qerr := client.Query(ctx, invalid)
+	_, serr := client.Subscribe(ctx, invalid)
+	for _, err := range []error{qerr, serr} {
+		var varErr ErrInvalidVariables
+		var typErr *json.UnsupportedTypeError
+		if !errors.As(err, &varErr) || !errors.As(err, &typErr) {
+			t.Logf("wrong error: %v", err)
+			t.Fail()
+			return
+		}
+	}
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Only the valid query should've been sent
+	msgs := srv.expect(t, gqlConnectionInit, gqlStart)
+	if len(msgs) == 2 && msgs[1].Payload.(*Request).Query != "{ hello }" {
+		t.Logf("unexpected operation sent: %v", msgs[1].Payload)
+		t.Fail()
+		return
+	}
+}
+
+func TestQuery_CompleteBeforeData(t *testing.T) {
+	srv := newRecordingServer(func(conn *Conn, msg operationMessage) {
+		if msg.Type == gqlStart {
+			conn.write(context.Background(), operationMessage{ID: msg.ID, Type: gqlComplete})
+		}
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	resp, err := client.Query(ctx, &Request{Query: "{ hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if resp == nil || resp.Data != nil || resp.Errors != nil {
+		t.Logf("expected an empty response, but got: %#v", resp)
+		t.Fail()
+		return
+	}
+}
+
+func TestEmptyQuery(t *testing.T) {
+	var started int32
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		atomic.AddInt32(&started, 1)
+		return s.Close()
+	})))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("Rejected", func(subT *testing.T) {
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		_, err = client.Query(ctx, &Request{Query: " \n"})
+		if err != ErrEmptyQuery {
+			subT.Logf("expected: %v, got: %v", ErrEmptyQuery, err)
+			subT.Fail()
+			return
+		}
+
+		_, err = client.Subscribe(ctx, &Request{})
+		if err != ErrEmptyQuery {
+			subT.Logf("expected: %v, got: %v", ErrEmptyQuery, err)
+			subT.Fail()
+			return
+		}
+
+		if n := atomic.LoadInt32(&started); n != 0 {
+			subT.Logf("expected no operations to be sent, but %d were", n)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Allowed", func(subT *testing.T) {
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn, WithAllowEmptyQuery())
+		defer client.Close()
+
+		_, err = client.Query(ctx, &Request{})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		if n := atomic.LoadInt32(&started); n != 1 {
+			subT.Logf("expected the operation to be sent, but %d were", n)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestPersistedQuery(t *testing.T) {
+	var mu sync.Mutex
+	var queries []string
+	persisted := make(map[string]bool)
+
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		pq, _ := req.Extensions["persistedQuery"].(map[string]interface{})
+		hash, _ := pq["sha256Hash"].(string)
+
+		mu.Lock()
+		defer mu.Unlock()
+		queries = append(queries, req.Query)
+
+		if req.Query != "" {
+			persisted[hash] = true
+		}
+		if !persisted[hash] {
+			return s.Send(context.Background(), &Response{
+				Errors: []json.RawMessage{json.RawMessage(`{"message":"PersistedQueryNotFound"}`)},
+			})
+		}
+		return s.Send(context.Background(), &Response{Data: json.RawMessage(`{"hello":"world"}`)})
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for i := 0; i < 2; i++ {
+		resp, err := client.Query(ctx, PersistedQuery("{ hello }"))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(resp.Data) != `{"hello":"world"}` {
+			t.Logf("unexpected response: %s", resp.Data)
+			t.Fail()
+			return
+		}
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+
+	// The first query is retried with the full query, while the second is only sent by hash
+	expected := []string{"", "{ hello }", ""}
+	if len(queries) != len(expected) {
+		t.Logf("expected queries: %q, got: %q", expected, queries)
+		t.Fail()
+		return
+	}
+	for i := range expected {
+		if queries[i] != expected[i] {
+			t.Logf("expected queries: %q, got: %q", expected, queries)
+			t.Fail()
+			return
+		}
+	}
+}
+
+func TestClient_ActiveOperations(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		<-s.Context().Done()
+		return nil
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var subs []*Subscription
+	for i := 0; i < 2; i++ {
+		sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer sub.Unsubscribe()
+		subs = append(subs, sub)
+	}
+
+	ids := client.ActiveOperations()
+	if len(ids) != 2 || ids[0] != "1" || ids[1] != "2" {
+		t.Logf("expected active operations: [1 2], got: %v", ids)
+		t.Fail()
+		return
+	}
+
+	subs[0].Unsubscribe()
+
+	ids = client.ActiveOperations()
+	if len(ids) != 1 || ids[0] != "2" {
+		t.Logf("expected active operations: [2], got: %v", ids)
+		t.Fail()
+		return
+	}
+}
+
+func TestWithContextInjector(t *testing.T) {
+	exts := make(chan map[string]interface{}, 2)
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		exts <- req.Extensions
+		return s.Close()
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	type tenantKey struct{}
+	client := NewClient(conn, WithContextInjector(func(ctx context.Context) map[string]interface{} {
+		return map[string]interface{}{
+			"tenant": ctx.Value(tenantKey{}),
+			"trace":  "injected",
+		}
+	}))
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), tenantKey{}, "acme"), 5*time.Second)
+	defer cancel()
+
+	req := &Request{
+		Query:      "{ hello }",
+		Extensions: map[string]interface{}{"trace": "explicit"},
+	}
+	_, err = client.Query(ctx, req)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ext := <-exts
+	if ext["tenant"] != "acme" || ext["trace"] != "explicit" {
+		t.Logf("unexpected extensions: %v", ext)
+		t.Fail()
+		return
+	}
+	if len(req.Extensions) != 1 {
+		t.Logf("expected the request not to be modified, got extensions: %v", req.Extensions)
+		t.Fail()
+		return
+	}
+
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	ext = <-exts
+	if ext["tenant"] != "acme" || ext["trace"] != "injected" {
+		t.Logf("unexpected extensions: %v", ext)
+		t.Fail()
+		return
+	}
+}
+
+func TestWithOpIDGenerator(t *testing.T) {
+	done := make(chan struct{})
+	defer close(done)
+
+	started := make(chan OperationID, 1)
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		started <- s.ID()
+		<-done
+		return s.Close()
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var ids []OperationID
+	client := NewClient(conn, WithOpIDGenerator(func() OperationID {
+		ids = append(ids, "op")
+		return "op"
+	}))
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	if sub.ID() != "op" {
+		t.Logf("expected generated id but got: %s", sub.ID())
+		t.Fail()
+		return
+	}
+	if id := <-started; id != sub.ID() {
+		t.Logf("expected the server to see id: %s, but got: %s", sub.ID(), id)
+		t.Fail()
+		return
+	}
+
+	_, err = client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+	if err != ErrDuplicateOpID {
+		t.Logf("expected: %v, got: %v", ErrDuplicateOpID, err)
+		t.Fail()
+		return
+	}
+
+	if len(ids) != 2 {
+		t.Logf("expected generator to be called twice but was called %d times", len(ids))
+		t.Fail()
+		return
+	}
+}
+
+func TestWithRequestHook(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+		return s.Send(context.Background(), &Response{Data: json.RawMessage(`{"hello":"world"}`)})
 	})))
 	defer srv.Close()
 
@@ -264,20 +2411,181 @@ func TestContextCancel(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	defer conn.Close()
 
-	client := NewClient(conn)
-	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
-	if err == nil {
-		t.Log("expected an error")
+	type key struct{}
+	var mu sync.Mutex
+	var reqs []*Request
+	var resps []*Response
+	client := NewClient(
+		conn,
+		WithRequestHook(func(ctx context.Context, req *Request) {
+			mu.Lock()
+			defer mu.Unlock()
+			if ctx.Value(key{}) == nil {
+				t.Log("expected hook to be called with the request context")
+				t.Fail()
+			}
+			reqs = append(reqs, req)
+		}),
+		WithResponseHook(func(ctx context.Context, resp *Response, err error) {
+			mu.Lock()
+			defer mu.Unlock()
+			if err != nil {
+				t.Log("unexpected error:", err)
+				t.Fail()
+			}
+			resps = append(resps, resp)
+		}),
+	)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.WithValue(context.Background(), key{}, true), 5*time.Second)
+	defer cancel()
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	_, err = sub.Recv(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(reqs) != 2 || len(resps) != 2 {
+		t.Logf("expected 2 requests and responses, got: %d and %d", len(reqs), len(resps))
 		t.Fail()
 		return
 	}
 }
 
-func TestFailedIO(t *testing.T) {
+func TestClient_Ping(t *testing.T) {
+	t.Run("GraphQLTransportWS", func(subT *testing.T) {
+		h := NewHandler(HandlerFunc(testHandler)).(*handler)
+		h.wcOptions.Subprotocols = []string{SubprotocolGraphQLTransportWS}
+
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		err = client.Ping(ctx)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+	})
+
+	t.Run("GraphQLWS", func(subT *testing.T) {
+		srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler)))
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		err = client.Ping(context.Background())
+		if err != ErrPingUnsupported {
+			subT.Logf("expected: %s, but got: %v", ErrPingUnsupported, err)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("RespondToPing", func(subT *testing.T) {
+		pongs := make(chan string, 1)
+		srv := newTestServer(func(conn *Conn) {
+			defer conn.wc.CloseRead(context.Background())
+
+			conn.read(context.Background())
+			conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+			conn.wc.Write(context.Background(), websocket.MessageText, []byte(`{"type":"ping","payload":{"seq":1}}`))
+
+			b, _ := conn.read(context.Background())
+			pongs <- string(b)
+		})
+		defer srv.Close()
+
+		conn, err := Dial(
+			context.Background(),
+			"ws://"+srv.Listener.Addr().String(),
+			WithSubprotocols(SubprotocolGraphQLTransportWS),
+		)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		select {
+		case pong := <-pongs:
+			if pong != "{\"type\":\"pong\",\"payload\":{\"seq\":1}}\n" {
+				subT.Logf("unexpected pong: %s", pong)
+				subT.Fail()
+				return
+			}
+		case <-time.After(2 * time.Second):
+			subT.Log("never received pong")
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestWithReconnect(t *testing.T) {
+	var dials int32
+	ids := make(chan OperationID, 2)
 	srv := newTestServer(func(conn *Conn) {
-		conn.wc.CloseRead(context.Background())
+		n := atomic.AddInt32(&dials, 1)
+
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+		b, _ := conn.read(context.Background())
+		var msg operationMessage
+		msg.UnmarshalJSON(b)
+		ids <- msg.ID
+
+		conn.write(context.Background(), operationMessage{
+			ID:      msg.ID,
+			Type:    gqlData,
+			Payload: &Response{Data: []byte(strconv.Itoa(int(n)))},
+		})
+
+		if n == 1 {
+			// Abruptly drop the first connection
+			conn.wc.Close(websocket.StatusGoingAway, "restarting")
+			return
+		}
+		<-conn.wc.CloseRead(context.Background()).Done()
 	})
 	defer srv.Close()
 
@@ -286,28 +2594,148 @@ func TestFailedIO(t *testing.T) {
 		t.Error(err)
 		return
 	}
-	conn.Close()
 
-	client := NewClient(conn)
+	bc := backoff.Config{BaseDelay: 10 * time.Millisecond, Multiplier: 1.6, MaxDelay: 100 * time.Millisecond}
+	client := NewClient(conn, WithReconnect(bc))
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, want := range []string{"1", "2"} {
+		resp, err := sub.Recv(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(resp.Data) != want {
+			t.Logf("expected data: %s, but got: %s", want, string(resp.Data))
+			t.Fail()
+			return
+		}
+	}
+
+	if first, second := <-ids, <-ids; first != second {
+		t.Logf("subscription was restarted with a different id: %s != %s", first, second)
+		t.Fail()
+		return
+	}
+}
+
+type backoffFunc func(int) time.Duration
+
+func (f backoffFunc) Backoff(retries int) time.Duration { return f(retries) }
+
+func TestWithReconnect_OnlySubscriptions(t *testing.T) {
+	var dials int32
+	starts := make(chan OperationID, 3)
+	srv := newTestServer(func(conn *Conn) {
+		n := atomic.AddInt32(&dials, 1)
+
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+		if n == 1 {
+			// Wait for both the subscription and query
+			conn.read(context.Background())
+			conn.read(context.Background())
+			conn.wc.Close(websocket.StatusGoingAway, "restarting")
+			return
+		}
+
+		for {
+			b, err := conn.read(context.Background())
+			if err != nil {
+				return
+			}
+
+			var msg operationMessage
+			msg.UnmarshalJSON(b)
+			switch msg.Type {
+			case gqlStart:
+				starts <- msg.ID
+			case gqlConnectionTerminate:
+				conn.wc.Close(websocket.StatusNormalClosure, "closed")
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var attempts int32
+	bs := backoffFunc(func(int) time.Duration {
+		atomic.AddInt32(&attempts, 1)
+		return 10 * time.Millisecond
+	})
+
+	client := NewClient(conn, WithReconnect(bs))
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	_, err = client.Query(context.Background(), &Request{})
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
 
+	_, err = client.Query(ctx, &Request{Query: "mutation { hello { world } }"})
 	var ioErr ErrIO
 	if !errors.As(err, &ioErr) {
-		t.Logf("wrong error: %s", err)
+		t.Logf("expected query to fail with the connection but got: %v", err)
+		t.Fail()
+		return
+	}
+
+	select {
+	case id := <-starts:
+		if id != sub.id {
+			t.Logf("expected only subscription %s to be restarted but got: %s", sub.id, id)
+			t.Fail()
+			return
+		}
+	case <-ctx.Done():
+		t.Log("subscription was never restarted")
+		t.Fail()
+		return
+	}
+
+	select {
+	case id := <-starts:
+		t.Logf("unexpected operation restarted: %s", id)
+		t.Fail()
+		return
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	if atomic.LoadInt32(&attempts) == 0 {
+		t.Log("backoff strategy was never used")
 		t.Fail()
 		return
 	}
-	t.Log(ioErr)
 }
 
-func TestUnexpectedAckMessage(t *testing.T) {
+func TestWithMaxReconnectAttempts(t *testing.T) {
 	srv := newTestServer(func(conn *Conn) {
-		conn.wc.CloseRead(context.Background())
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
 
-		conn.write(context.Background(), operationMessage{Type: gqlData})
+		conn.read(context.Background())
+		conn.wc.Close(websocket.StatusGoingAway, "shutting down")
 	})
-	defer srv.Close()
 
 	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
 	if err != nil {
@@ -315,24 +2743,124 @@ func TestUnexpectedAckMessage(t *testing.T) {
 		return
 	}
 
-	client := NewClient(conn)
-	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	bc := backoff.Config{BaseDelay: 10 * time.Millisecond, Multiplier: 1.6, MaxDelay: 100 * time.Millisecond}
+	closeErr := make(chan error, 1)
+	client := NewClient(conn, WithReconnect(bc), WithMaxReconnectAttempts(2), WithCloseHandler(func(err error) {
+		closeErr <- err
+	}))
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 
-	_, err = client.Query(ctx, &Request{})
-	if err == nil {
-		t.Log("expected error")
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Every reconnect attempt will now fail
+	srv.Close()
+
+	_, err = sub.Recv(ctx)
+	if err != ErrUnsubscribed {
+		t.Logf("expected: %s, but got: %v", ErrUnsubscribed, err)
 		t.Fail()
 		return
 	}
 
-	var msgErr ErrUnexpectedMessage
-	if !errors.As(err, &msgErr) {
-		t.Logf("wrong error: %s", err)
+	select {
+	case <-ctx.Done():
+		t.Error(ctx.Err())
+		return
+	case err = <-closeErr:
+	}
+
+	var exhausted ErrReconnectExhausted
+	if !errors.As(err, &exhausted) || exhausted.Attempts != 2 || exhausted.Err == nil {
+		t.Logf("expected reconnecting to be exhausted after 2 attempts, but got: %v", err)
 		t.Fail()
 		return
 	}
-	t.Log(msgErr)
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if !errors.As(err, &exhausted) {
+		t.Logf("expected subsequent queries to fail with: %v, but got: %v", exhausted, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestIdleConnection(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		// Stay idle for longer than any internal read timeout
+		time.Sleep(defaultTimeout + time.Second)
+		return testHandler(s, req)
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
+func TestUnknownMessageType(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		defer conn.wc.CloseRead(context.Background())
+
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+
+		b, err := conn.read(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		msg := new(operationMessage)
+		err = msg.UnmarshalJSON(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		conn.wc.Write(context.Background(), websocket.MessageBinary, []byte(`{"type":"future_thing","payload":{"hello":"world"}}`))
+		conn.write(context.Background(), operationMessage{
+			ID:      msg.ID,
+			Type:    gqlData,
+			Payload: &Response{Data: []byte(`{"hello":{"world":"this is a test"}}`)},
+		})
+		conn.write(context.Background(), operationMessage{ID: msg.ID, Type: gqlComplete})
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	client := NewClient(conn)
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
 }
 
 const (
@@ -379,7 +2907,7 @@ func TestMalformedMessage(t *testing.T) {
 			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
 			defer cancel()
 
-			_, err = client.Query(ctx, &Request{})
+			_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
 			if err == nil {
 				subT.Log("expected error")
 				subT.Fail()
@@ -412,7 +2940,6 @@ func ExampleNewClient_query() {
 		// Remember, always handle errors
 		return
 	}
-	// Always check resp.Errors
 
 	var exampleResp struct {
 		Hello struct {
@@ -420,7 +2947,8 @@ func ExampleNewClient_query() {
 		} `json:"hello"`
 	}
 
-	err = json.Unmarshal(resp.Data, &exampleResp)
+	// Into also checks resp.Errors for you
+	err = resp.Into(&exampleResp)
 	if err != nil {
 		return
 	}
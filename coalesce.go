@@ -0,0 +1,116 @@
+package gws
+
+import (
+	"bytes"
+	"context"
+	"net"
+	"sync"
+	"time"
+)
+
+// WithWriteCoalescing configures the connection to hold writes for up to
+// delay, so the frames of several messages written in quick succession are
+// flushed to the network at once, rather than costing a syscall, and likely
+// a packet, each. Every message is still sent as its own frame, as both
+// subprotocols require. It trades latency for throughput, so it's only
+// worthwhile under heavy traffic of small messages. By default, writes are
+// flushed immediately.
+//
+// Coalescing applies to the network connections dialed by the http client's
+// transport, which must be an *http.Transport. Writes are also flushed once
+// 64 KiB is held, or the connection is closed. Write errors are reported by
+// the next write, and fail the connection.
+//
+func WithWriteCoalescing(delay time.Duration) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.coalesce = delay
+	})
+}
+
+// maxCoalesced is the most bytes held before they're flushed regardless.
+const maxCoalesced = 64 << 10
+
+// coalesceDial wraps dial, so the connections it dials coalesce their writes.
+func coalesceDial(dial func(context.Context, string, string) (net.Conn, error), delay time.Duration) func(context.Context, string, string) (net.Conn, error) {
+	return func(ctx context.Context, network, addr string) (net.Conn, error) {
+		conn, err := dial(ctx, network, addr)
+		if err != nil {
+			return nil, err
+		}
+		return &coalescingConn{Conn: conn, delay: delay}, nil
+	}
+}
+
+// coalescingConn holds writes for up to delay and then
+// flushes them to the underlying connection at once.
+//
+type coalescingConn struct {
+	net.Conn
+	delay time.Duration
+
+	mu    sync.Mutex
+	buf   bytes.Buffer
+	timer *time.Timer
+
+	// set once a flush fails
+	err error
+}
+
+// Write implements the io.Writer interface.
+func (c *coalescingConn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.err != nil {
+		return 0, c.err
+	}
+
+	c.buf.Write(b)
+	if c.buf.Len() >= maxCoalesced {
+		return len(b), c.flushLocked()
+	}
+	if c.timer == nil {
+		c.timer = time.AfterFunc(c.delay, c.flush)
+	}
+	return len(b), nil
+}
+
+// Close flushes any held writes and closes the underlying connection.
+func (c *coalescingConn) Close() error {
+	c.mu.Lock()
+	c.flushLocked()
+	c.mu.Unlock()
+
+	return c.Conn.Close()
+}
+
+func (c *coalescingConn) flush() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.flushLocked()
+}
+
+// flushLocked writes the held bytes to the underlying connection.
+// It must be called with c.mu held.
+//
+func (c *coalescingConn) flushLocked() error {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if c.err != nil || c.buf.Len() == 0 {
+		return c.err
+	}
+
+	_, err := c.Conn.Write(c.buf.Bytes())
+	c.buf.Reset()
+	if err != nil {
+		// The write may have been partial, so the stream is
+		// corrupt and reads must fail, along with later writes.
+		//
+		c.err = err
+		c.Conn.Close()
+	}
+	return err
+}
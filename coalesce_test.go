@@ -0,0 +1,231 @@
+package gws
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// writeCounter counts the writes made to the network connection.
+type writeCounter struct {
+	net.Conn
+
+	writes int32
+}
+
+func (c *writeCounter) Write(b []byte) (int, error) {
+	atomic.AddInt32(&c.writes, 1)
+	return c.Conn.Write(b)
+}
+
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
+
+func TestWithWriteCoalescing(t *testing.T) {
+	const n = 10
+
+	testCases := []struct {
+		Name      string
+		Delay     time.Duration
+		MaxWrites int32
+	}{
+		{Name: "Disabled", MaxWrites: n},
+		{Name: "Enabled", Delay: 50 * time.Millisecond, MaxWrites: 1},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			ids := make(chan OperationID, n)
+			srv := newTestServer(func(conn *Conn) {
+				for {
+					b, err := conn.read(context.Background())
+					if err != nil {
+						return
+					}
+					msg := new(operationMessage)
+					msg.UnmarshalJSON(b)
+					ids <- msg.ID
+				}
+			})
+			defer srv.Close()
+
+			var counter *writeCounter
+			dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				counter = &writeCounter{Conn: conn}
+				return counter, nil
+			}
+
+			conn, err := Dial(
+				context.Background(),
+				"ws://"+srv.Listener.Addr().String(),
+				WithNetDialContext(dial),
+				WithWriteCoalescing(testCase.Delay),
+			)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			handshake := atomic.LoadInt32(&counter.writes)
+			for i := 0; i < n; i++ {
+				err = conn.write(ctx, operationMessage{ID: OperationID(strconv.Itoa(i)), Type: gqlStop})
+				if err != nil {
+					subT.Error(err)
+					return
+				}
+			}
+
+			// Every message is still received, in order, as its own frame
+			for i := 0; i < n; i++ {
+				select {
+				case <-ctx.Done():
+					subT.Error(ctx.Err())
+					return
+				case id := <-ids:
+					if id != OperationID(strconv.Itoa(i)) {
+						subT.Logf("expected message: %d, but got: %s", i, id)
+						subT.Fail()
+						return
+					}
+				}
+			}
+
+			if writes := atomic.LoadInt32(&counter.writes) - handshake; writes > testCase.MaxWrites {
+				subT.Logf("expected at most %d writes, but got: %d", testCase.MaxWrites, writes)
+				subT.Fail()
+				return
+			}
+		})
+	}
+
+	t.Run("Client", func(subT *testing.T) {
+		srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler)))
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), WithWriteCoalescing(time.Millisecond))
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+	})
+
+	t.Run("FlushOnClose", func(subT *testing.T) {
+		client, server := net.Pipe()
+		conn := &coalescingConn{Conn: client, delay: time.Hour}
+
+		conn.Write([]byte("hello "))
+		conn.Write([]byte("world"))
+		go conn.Close()
+
+		b, err := ioutil.ReadAll(server)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		if string(b) != "hello world" {
+			subT.Logf("expected held writes to be flushed, but got: %q", string(b))
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("ConflictingTransport", func(subT *testing.T) {
+		client := &http.Client{Transport: roundTripperFunc(http.DefaultTransport.RoundTrip)}
+
+		_, err := Dial(context.Background(), "ws://localhost", WithHTTPClient(client), WithWriteCoalescing(time.Millisecond))
+		if err != ErrConflictingDialer {
+			subT.Logf("expected: %v, got: %v", ErrConflictingDialer, err)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func BenchmarkWithWriteCoalescing(b *testing.B) {
+	srv := newTestServer(func(conn *Conn) {
+		for {
+			_, err := conn.read(context.Background())
+			if err != nil {
+				return
+			}
+		}
+	})
+	defer srv.Close()
+
+	benchmarks := []struct {
+		Name  string
+		Delay time.Duration
+	}{
+		{Name: "Disabled"},
+		{Name: "1ms", Delay: time.Millisecond},
+	}
+
+	for _, bm := range benchmarks {
+		b.Run(bm.Name, func(subB *testing.B) {
+			var counter *writeCounter
+			dial := func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				counter = &writeCounter{Conn: conn}
+				return counter, nil
+			}
+
+			conn, err := Dial(
+				context.Background(),
+				"ws://"+srv.Listener.Addr().String(),
+				WithNetDialContext(dial),
+				WithWriteCoalescing(bm.Delay),
+			)
+			if err != nil {
+				subB.Fatal(err)
+			}
+			handshake := atomic.LoadInt32(&counter.writes)
+
+			msg := operationMessage{ID: "1", Type: gqlStop}
+
+			subB.ReportAllocs()
+			subB.ResetTimer()
+			for i := 0; i < subB.N; i++ {
+				err = conn.write(context.Background(), msg)
+				if err != nil {
+					subB.Fatal(err)
+				}
+			}
+
+			// Closing waits for the server to have read every message
+			conn.Close()
+			subB.StopTimer()
+
+			writes := atomic.LoadInt32(&counter.writes) - handshake
+			subB.ReportMetric(float64(writes)/float64(subB.N), "writes/op")
+		})
+	}
+}
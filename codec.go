@@ -0,0 +1,58 @@
+package gws
+
+import (
+	"bytes"
+	"encoding/json"
+)
+
+// Codec marshals and unmarshals messages e.g. to use a faster JSON library
+// than encoding/json or to customize how numbers are decoded. Codecs must
+// respect the json.Marshaler and json.Unmarshaler interfaces, as well as
+// the "json" struct tags, like encoding/json does.
+//
+type Codec interface {
+	Marshal(v interface{}) ([]byte, error)
+	Unmarshal(data []byte, v interface{}) error
+}
+
+type codecOpt struct {
+	c Codec
+}
+
+func (o codecOpt) SetDial(opts *dialOpts) {
+	opts.codec = o.c
+}
+
+func (o codecOpt) SetServer(opts *options) {
+	opts.codec = o.c
+}
+
+// WithCodec configures the codec used to marshal and unmarshal messages,
+// including decoding responses with Response.Into. By default,
+// encoding/json is used.
+//
+func WithCodec(c Codec) ConnOption {
+	return codecOpt{c: c}
+}
+
+// marshal encodes v into buf, with the codec or encoding/json, if it's nil.
+func marshal(c Codec, buf *bytes.Buffer, v interface{}) error {
+	if c == nil {
+		return json.NewEncoder(buf).Encode(v)
+	}
+
+	b, err := c.Marshal(v)
+	if err != nil {
+		return err
+	}
+	buf.Write(b)
+	return nil
+}
+
+// unmarshal decodes b into v, with the codec or encoding/json, if it's nil.
+func unmarshal(c Codec, b []byte, v interface{}) error {
+	if c == nil {
+		return json.Unmarshal(b, v)
+	}
+	return c.Unmarshal(b, v)
+}
@@ -0,0 +1,78 @@
+package gws
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// numberCodec decodes numbers as json.Number and counts its usage.
+type numberCodec struct {
+	marshaled   int64
+	unmarshaled int64
+}
+
+func (c *numberCodec) Marshal(v interface{}) ([]byte, error) {
+	atomic.AddInt64(&c.marshaled, 1)
+	return json.Marshal(v)
+}
+
+func (c *numberCodec) Unmarshal(b []byte, v interface{}) error {
+	atomic.AddInt64(&c.unmarshaled, 1)
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	return dec.Decode(v)
+}
+
+func TestWithCodec(t *testing.T) {
+	srvCodec := new(numberCodec)
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+		return s.Send(context.Background(), &Response{Data: json.RawMessage(`{"count":12345678901234567890}`)})
+	}), WithCodec(srvCodec)))
+	defer srv.Close()
+
+	cliCodec := new(numberCodec)
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), WithCodec(cliCodec))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Query(ctx, &Request{Query: "{ count }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	var data map[string]interface{}
+	err = resp.Into(&data)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	n, ok := data["count"].(json.Number)
+	if !ok || n.String() != "12345678901234567890" {
+		t.Logf("expected count to be decoded as a json.Number but got: %#v", data["count"])
+		t.Fail()
+		return
+	}
+
+	for name, c := range map[string]*numberCodec{"client": cliCodec, "server": srvCodec} {
+		if atomic.LoadInt64(&c.marshaled) == 0 || atomic.LoadInt64(&c.unmarshaled) == 0 {
+			t.Logf("expected %s codec to be used", name)
+			t.Fail()
+		}
+	}
+}
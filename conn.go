@@ -3,11 +3,18 @@ package gws
 import (
 	"bytes"
 	"context"
+	"crypto/tls"
 	"encoding/json"
 	"errors"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
+	"runtime/debug"
+	"strconv"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/zaba505/gws/backoff"
@@ -18,14 +25,57 @@ import (
 
 const minConnectTimeout = 20 * time.Second
 
+// Subprotocols implemented by this package.
+const (
+	// SubprotocolGraphQLWS is the legacy Apollo "GraphQL over WebSocket" protocol,
+	// as described in PROTOCOL.md.
+	SubprotocolGraphQLWS = "graphql-ws"
+
+	// SubprotocolGraphQLTransportWS is the newer protocol implemented by
+	// the graphql-ws library and Apollo Server 3+. See
+	// https://github.com/enisdenjo/graphql-ws/blob/master/PROTOCOL.md
+	//
+	SubprotocolGraphQLTransportWS = "graphql-transport-ws"
+)
+
+// subprotocols lists the supported subprotocols in order of preference.
+var subprotocols = []string{SubprotocolGraphQLWS, SubprotocolGraphQLTransportWS}
+
+// transportWSTypes maps the "graphql-ws" message types, which are used
+// internally, to their "graphql-transport-ws" equivalents.
+//
+var transportWSTypes = map[reqType]reqType{
+	gqlStart:               gqlSubscribe,
+	gqlStop:                gqlComplete,
+	gqlData:                gqlNext,
+	gqlConnectionKeepAlive: gqlPong,
+}
+
 type dialOpts struct {
 	bs                internalbackoff.Strategy
 	minConnectTimeout func() time.Duration
 	client            *http.Client
 	headers           http.Header
+	origin            string
+	userAgent         string
+	bearerToken       func(context.Context) (string, error)
 	compression       CompressionMode
 	threshold         int
 	typ               MessageType
+	subprotocols      []string
+	initParams        map[string]interface{}
+	initRetry         func(context.Context, error) (json.RawMessage, error)
+	initPayload       json.RawMessage // refreshed by initRetry
+	ackTimeout        time.Duration
+	writeTimeout      time.Duration
+	readLimit         int64
+	metrics           Metrics
+	logger            Logger
+	tlsConfig         *tls.Config
+	proxy             func(*http.Request) (*url.URL, error)
+	dialContext       func(context.Context, string, string) (net.Conn, error)
+	coalesce          time.Duration
+	codec             Codec
 }
 
 // DialOption configures how we set up the connection.
@@ -48,6 +98,16 @@ func (f optionFn) SetDial(opts *dialOpts) { f(opts) }
 // should. It is however currently disabled due to Safari bugs. See
 // https://github.com/nhooyr/websocket/issues/218
 //
+// The underlying websocket library provides no way to re-enable it, so only
+// permessage-deflate is ever negotiated. Peers which only offer deflate-frame,
+// such as older versions of Safari, fall back to uncompressed messages.
+//
+// Messages are only compressed if both peers enable compression, in which
+// case CompressionNoContextTakeover and CompressionContextTakeover interoperate
+// in any combination. Context takeover is only used if both peers select
+// CompressionContextTakeover. If either peer selects CompressionDisabled, or
+// doesn't support permessage-deflate, messages are sent uncompressed.
+//
 type CompressionMode websocket.CompressionMode
 
 const (
@@ -58,7 +118,8 @@ const (
 	// will not be used but the memory overhead will be lower if the connections
 	// are long lived and seldom used.
 	//
-	// The message will only be compressed if greater than 512 bytes.
+	// By default, the message will only be compressed if it's at least 512 bytes.
+	// See WithCompression.
 	//
 	CompressionNoContextTakeover CompressionMode = iota
 
@@ -108,7 +169,15 @@ func (opt compression) SetServer(opts *options) {
 // By default, compression is disabled and for now is considered
 // an experimental feature.
 //
+// Only messages of at least threshold bytes are compressed, since compressing
+// small messages rarely pays off. A threshold of zero, or less, selects the
+// default of 512 bytes for CompressionNoContextTakeover and 128 bytes for
+// CompressionContextTakeover. To compress every message, use a threshold of 1.
+//
 func WithCompression(mode CompressionMode, threshold int) ConnOption {
+	if threshold < 0 {
+		threshold = 0
+	}
 	return compression{
 		mode:      mode,
 		threshold: threshold,
@@ -135,14 +204,141 @@ func (t mtyp) SetServer(opts *options) {
 }
 
 // WithMessageType allows users to set the underlying WebSocket message encoding.
-// Default is MessageBinary.
-//
-// Note: for browser clients like Apollo GraphQL the MessageText encoding should be used.
+// Default is MessageText, as expected by most "GraphQL over WebSocket" implementations
+// e.g. Apollo GraphQL. Messages are read regardless of their encoding.
 //
 func WithMessageType(typ MessageType) ConnOption {
 	return mtyp(typ)
 }
 
+type writeTimeout time.Duration
+
+func (t writeTimeout) SetDial(opts *dialOpts) {
+	opts.writeTimeout = time.Duration(t)
+}
+
+func (t writeTimeout) SetServer(opts *options) {
+	opts.writeTimeout = time.Duration(t)
+}
+
+// WithWriteTimeout bounds every message written to the connection,
+// including the connection_terminate sent by Close. A write which
+// exceeds the timeout fails with ErrWriteTimeout and, since the
+// message may have been partially written, the connection is closed.
+//
+func WithWriteTimeout(timeout time.Duration) ConnOption {
+	return writeTimeout(timeout)
+}
+
+type readLimit int64
+
+func (l readLimit) SetDial(opts *dialOpts) {
+	opts.readLimit = int64(l)
+}
+
+func (l readLimit) SetServer(opts *options) {
+	opts.readLimit = int64(l)
+}
+
+// WithReadLimit sets the maximum size, in bytes, of a message read from
+// the connection. A message which exceeds the limit fails the read with
+// ErrMessageTooLarge and closes the connection with StatusMessageTooBig.
+//
+// By default, the limit is 32768 bytes.
+//
+func WithReadLimit(n int64) ConnOption {
+	return readLimit(n)
+}
+
+// ErrMessageTooLarge is returned when a message
+// exceeds the limit set by WithReadLimit.
+//
+type ErrMessageTooLarge struct {
+	// Limit is the read limit which was exceeded.
+	Limit int64
+}
+
+// Error implements the error interface.
+func (e ErrMessageTooLarge) Error() string {
+	return "gws: message exceeds read limit of " + strconv.FormatInt(e.Limit, 10) + " bytes"
+}
+
+// ErrConnectionClosed is returned for in-flight operations when the
+// connection is closed, either by the peer or locally, as opposed to
+// failing due to a malformed message or a timeout. Use errors.Is to
+// check for it, since the underlying error is wrapped.
+//
+var ErrConnectionClosed = errors.New("gws: connection closed")
+
+type connClosedError struct {
+	err error
+}
+
+func (e connClosedError) Error() string {
+	return ErrConnectionClosed.Error() + ": " + e.err.Error()
+}
+
+func (e connClosedError) Is(target error) bool {
+	return target == ErrConnectionClosed
+}
+
+func (e connClosedError) Unwrap() error {
+	return e.err
+}
+
+// CloseCode represents a WebSocket close status code.
+type CloseCode int
+
+// Close codes defined by the "graphql-transport-ws" subprotocol.
+const (
+	CloseBadRequest          CloseCode = 4400
+	CloseUnauthorized        CloseCode = 4401
+	CloseForbidden           CloseCode = 4403
+	CloseInitTimeout         CloseCode = 4408
+	CloseSubscriberExists    CloseCode = 4409
+	CloseTooManyInitRequests CloseCode = 4429
+)
+
+// CloseError is returned when the peer closes the connection with a
+// WebSocket close frame. It may be checked for with errors.As, in order
+// to branch on the close code. It also matches ErrConnectionClosed.
+//
+type CloseError struct {
+	code   CloseCode
+	reason string
+	err    error
+}
+
+// Code returns the close status code sent by the peer.
+func (e *CloseError) Code() CloseCode {
+	return e.code
+}
+
+// Reason returns the close reason sent by the peer.
+func (e *CloseError) Reason() string {
+	return e.reason
+}
+
+// Error implements the error interface.
+func (e *CloseError) Error() string {
+	return ErrConnectionClosed.Error() + ": status = " + strconv.Itoa(int(e.code)) + " and reason = " + strconv.Quote(e.reason)
+}
+
+// Is reports whether target is ErrConnectionClosed.
+func (e *CloseError) Is(target error) bool {
+	return target == ErrConnectionClosed
+}
+
+// Unwrap returns the underlying WebSocket error.
+func (e *CloseError) Unwrap() error {
+	return e.err
+}
+
+// ErrWriteTimeout is returned when writing a message
+// exceeds the timeout set by WithWriteTimeout.
+//
+var ErrWriteTimeout = errors.New("gws: write timed out")
+
 // WithHTTPClient provides an http.Client to override the default one used.
 func WithHTTPClient(client *http.Client) DialOption {
 	return optionFn(func(opts *dialOpts) {
@@ -150,13 +346,332 @@ func WithHTTPClient(client *http.Client) DialOption {
 	})
 }
 
-// WithHeaders adds custom headers to every dial HTTP request.
+// ErrConflictingTLSConfig is returned by Dial when WithTLSConfig is used
+// along with an http.Client, whose transport already configures TLS or
+// isn't an *http.Transport.
+//
+var ErrConflictingTLSConfig = errors.New("gws: tls config conflicts with the http client transport")
+
+// WithTLSConfig configures the TLS config used to dial the server e.g. to
+// present a client certificate for mutual TLS or trust a custom root CA.
+//
+// It may be combined with WithHTTPClient, as long as the client's transport is
+// an *http.Transport without a TLS config of its own.
+//
+func WithTLSConfig(cfg *tls.Config) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.tlsConfig = cfg
+	})
+}
+
+// ErrConflictingProxy is returned by Dial when WithProxy is used along
+// with an http.Client, whose transport isn't the default one.
+//
+var ErrConflictingProxy = errors.New("gws: proxy conflicts with the http client transport")
+
+// WithProxy configures the proxy used to dial the server, in the same
+// fashion as http.Transport.Proxy e.g. http.ProxyURL(u).
+//
+// It may be combined with WithHTTPClient, as long as the client uses
+// the default transport.
+//
+func WithProxy(proxy func(*http.Request) (*url.URL, error)) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.proxy = proxy
+	})
+}
+
+// ErrConflictingDialer is returned by Dial when WithNetDialContext is used
+// along with an http.Client, whose transport already has a dial func of its
+// own or isn't an *http.Transport. It's also returned when WithWriteCoalescing
+// is used along with an http.Client, whose transport isn't an *http.Transport.
+//
+var ErrConflictingDialer = errors.New("gws: dialer conflicts with the http client transport")
+
+// WithNetDialContext configures the func used to establish the underlying
+// network connection, in the same fashion as http.Transport.DialContext e.g.
+// to connect over a unix domain socket, with an endpoint such as ws://unix/.
+//
+// It may be combined with WithHTTPClient, as long as the client's transport is
+// an *http.Transport without a dial func of its own.
+//
+func WithNetDialContext(dial func(ctx context.Context, network, addr string) (net.Conn, error)) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.dialContext = dial
+	})
+}
+
+// applyTransport configures the http client to dial with the tls
+// config, through the proxy and dialer, and to coalesce writes.
+//
+func (opts *dialOpts) applyTransport() error {
+	if opts.tlsConfig == nil && opts.proxy == nil && opts.dialContext == nil && opts.coalesce <= 0 {
+		return nil
+	}
+
+	var t *http.Transport
+	switch rt := opts.client.Transport.(type) {
+	case nil:
+		t = http.DefaultTransport.(*http.Transport).Clone()
+	case *http.Transport:
+		if rt == http.DefaultTransport {
+			t = rt.Clone()
+			break
+		}
+		if opts.proxy != nil {
+			return ErrConflictingProxy
+		}
+		if opts.tlsConfig != nil && rt.TLSClientConfig != nil {
+			return ErrConflictingTLSConfig
+		}
+		if opts.dialContext != nil && (rt.DialContext != nil || rt.Dial != nil) {
+			return ErrConflictingDialer
+		}
+		t = rt.Clone()
+	default:
+		if opts.proxy != nil {
+			return ErrConflictingProxy
+		}
+		if opts.tlsConfig != nil {
+			return ErrConflictingTLSConfig
+		}
+		return ErrConflictingDialer
+	}
+	if opts.tlsConfig != nil {
+		t.TLSClientConfig = opts.tlsConfig
+	}
+	if opts.proxy != nil {
+		t.Proxy = opts.proxy
+	}
+	if opts.dialContext != nil {
+		t.DialContext = opts.dialContext
+	}
+	if opts.coalesce > 0 {
+		dial := t.DialContext
+		if dial == nil && t.Dial != nil {
+			tdial := t.Dial
+			dial = func(_ context.Context, network, addr string) (net.Conn, error) {
+				return tdial(network, addr)
+			}
+		}
+		if dial == nil {
+			dial = new(net.Dialer).DialContext
+		}
+		t.DialContext = coalesceDial(dial, opts.coalesce)
+		if t.DialTLSContext != nil {
+			t.DialTLSContext = coalesceDial(t.DialTLSContext, opts.coalesce)
+		}
+	}
+
+	client := *opts.client
+	client.Transport = t
+	opts.client = &client
+	return nil
+}
+
+// WithHeaders adds custom headers to every dial HTTP request. It may be
+// combined with WithHeader and used more than once, in which case all of
+// the headers are added.
+//
 func WithHeaders(headers http.Header) DialOption {
 	return optionFn(func(opts *dialOpts) {
-		opts.headers = headers
+		for key, values := range headers {
+			for _, value := range values {
+				opts.addHeader(key, value)
+			}
+		}
+	})
+}
+
+// WithHeader adds a single custom header to every dial HTTP request e.g.
+// WithHeader("Authorization", "Bearer ..."). It may be used more than once,
+// in which case all of the values are added.
+//
+func WithHeader(key, value string) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.addHeader(key, value)
+	})
+}
+
+// addHeader appends value to the headers for key. The headers are
+// copied, as they're added, so the supplied ones are never modified.
+//
+func (opts *dialOpts) addHeader(key, value string) {
+	if opts.headers == nil {
+		opts.headers = make(http.Header)
+	}
+	opts.headers.Add(key, value)
+}
+
+// WithOrigin sets the Origin header of every dial HTTP request, which
+// servers commonly validate. It takes precedence over any Origin header
+// set with WithHeaders.
+//
+func WithOrigin(origin string) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.origin = origin
+	})
+}
+
+// WithUserAgent sets the User-Agent header of every dial HTTP request. It
+// takes precedence over any User-Agent header set with WithHeaders. By
+// default, the User-Agent identifies this package and, if known, its version.
+//
+func WithUserAgent(userAgent string) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.userAgent = userAgent
+	})
+}
+
+// defaultUserAgent identifies this package, and its version,
+// in dial HTTP requests which don't set a User-Agent.
+//
+var defaultUserAgent = userAgent("github.com/zaba505/gws")
+
+// userAgent returns the User-Agent for the module at path,
+// including its version if it's a dependency of the binary.
+//
+func userAgent(path string) string {
+	const name = "graphql-transport-ws-go"
+
+	info, ok := debug.ReadBuildInfo()
+	if !ok {
+		return name
+	}
+	for _, dep := range info.Deps {
+		if dep.Path == path && dep.Version != "" {
+			return name + "/" + dep.Version
+		}
+	}
+	return name
+}
+
+// header returns the headers for the dial HTTP request.
+func (opts *dialOpts) header(ctx context.Context) (http.Header, error) {
+	h := opts.headers.Clone()
+	if h == nil {
+		h = make(http.Header)
+	}
+	if opts.origin != "" {
+		h.Set("Origin", opts.origin)
+	}
+	if opts.userAgent != "" {
+		h.Set("User-Agent", opts.userAgent)
+	} else if h.Get("User-Agent") == "" {
+		h.Set("User-Agent", defaultUserAgent)
+	}
+	if opts.bearerToken != nil {
+		token, err := opts.bearerToken(ctx)
+		if err != nil {
+			return nil, err
+		}
+		h.Set("Authorization", "Bearer "+token)
+	}
+	return h, nil
+}
+
+// WithBearerToken sets the Authorization header of every dial HTTP request
+// to "Bearer <token>". It takes precedence over any Authorization header
+// set with WithHeaders or WithHeader.
+//
+func WithBearerToken(token string) DialOption {
+	return WithBearerTokenFunc(func(context.Context) (string, error) {
+		return token, nil
+	})
+}
+
+// WithBearerTokenFunc is like WithBearerToken, except the token is fetched
+// by calling f before every dial HTTP request, including when the client
+// reconnects, so an expired token may be refreshed. If f returns an error,
+// the dial fails with it.
+//
+func WithBearerTokenFunc(f func(context.Context) (string, error)) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.bearerToken = f
+	})
+}
+
+// WithSubprotocols overrides the subprotocols offered to the server, in order
+// of preference. By default, all subprotocols implemented by this package are
+// offered, with SubprotocolGraphQLWS preferred.
+//
+func WithSubprotocols(protos ...string) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.subprotocols = protos
+	})
+}
+
+// WithConnectionParams sets the payload sent along with the connection_init
+// message, which is commonly used by servers for authentication e.g.
+// {"authToken": "..."}.
+//
+func WithConnectionParams(params map[string]interface{}) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.initParams = params
+	})
+}
+
+// WithInitRetry registers f to be called when the server rejects the
+// connection_init handshake e.g. because the token in the connection params
+// has expired. f is called with the rejection and returns refreshed connection
+// params, with which the connection is re-dialed and the handshake retried
+// once. The refreshed params are then used for any subsequent reconnects.
+//
+// If f returns an error, the handshake fails with an ErrInitRetry wrapping it.
+//
+func WithInitRetry(f func(ctx context.Context, prevErr error) (json.RawMessage, error)) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.initRetry = f
+	})
+}
+
+// ErrInitRetry represents the failure of the WithInitRetry
+// hook to refresh the connection params.
+//
+type ErrInitRetry struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e ErrInitRetry) Error() string {
+	return "gws: failed to refresh connection params: " + e.Err.Error()
+}
+
+// Unwrap is for the errors package to use within its As, Is, and Unwrap functions.
+func (e ErrInitRetry) Unwrap() error {
+	return e.Err
+}
+
+// WithAckTimeout makes Dial perform the connection_init handshake, instead of
+// it being deferred until the connection is used by a Client. Dial will then
+// fail if a connection_ack isn't received within the given timeout, or if the
+// server rejects the connection with a connection_error.
+//
+func WithAckTimeout(timeout time.Duration) DialOption {
+	return optionFn(func(opts *dialOpts) {
+		opts.ackTimeout = timeout
 	})
 }
 
+// ErrUnsupportedSubprotocol represents a subprotocol which was
+// selected by the server but isn't implemented by this package.
+//
+type ErrUnsupportedSubprotocol string
+
+// Error implements the error interface.
+func (e ErrUnsupportedSubprotocol) Error() string {
+	return "gws: unsupported subprotocol selected by server: " + string(e)
+}
+
+func isSupported(proto string) bool {
+	for _, p := range subprotocols {
+		if p == proto {
+			return true
+		}
+	}
+	return false
+}
+
 // ConnectParams defines the parameters for connecting and retrying. Users are
 // encouraged to use this instead of the BackoffConfig type defined above. See
 // here for more details:
@@ -190,22 +705,62 @@ func WithConnectParams(p ConnectParams) DialOption {
 // Conn is a client connection that should be closed by the client.
 type Conn struct {
 	mtyp    websocket.MessageType
+	proto   string
 	wc      *websocket.Conn
 	bufPool *sync.Pool
 
-	done chan struct{}
+	// serializes writes to wc
+	writeMu      sync.Mutex
+	writeTimeout time.Duration
+
+	// 0 means the underlying default is used
+	readLimit int64
+
+	metrics Metrics
+	logger  Logger
+
+	// nil means encoding/json is used
+	codec Codec
+
+	terminateOnce sync.Once
+	terminateErr  error
+	peerClosed    int32
+
+	// sent with connection_init
+	initPayload json.RawMessage
+	acked       bool
+
+	// received with connection_ack, holds a json.RawMessage
+	ackPayload atomic.Value
+
+	// used for re-dialing, only set by Dial
+	endpoint string
+	dopts    *dialOpts
+
+	// the handshake response, only set by Dial
+	resp *http.Response
+
+	doneOnce sync.Once
+	done     chan struct{}
+	err      error
+
+	closeOnce sync.Once
+	closeErr  error
 }
 
 func newConn(wc *websocket.Conn, typ MessageType) *Conn {
 	c := &Conn{
-		mtyp: websocket.MessageType(typ),
-		wc:   wc,
+		mtyp:  websocket.MessageType(typ),
+		proto: wc.Subprotocol(),
+		wc:    wc,
 		bufPool: &sync.Pool{
 			New: func() interface{} {
 				return new(bytes.Buffer)
 			},
 		},
-		done: make(chan struct{}, 1),
+		metrics: NopMetrics{},
+		logger:  nopLogger{},
+		done:    make(chan struct{}, 1),
 	}
 
 	return c
@@ -218,8 +773,10 @@ func newConn(wc *websocket.Conn, typ MessageType) *Conn {
 func Dial(ctx context.Context, endpoint string, opts ...DialOption) (*Conn, error) {
 	fopts := []DialOption{
 		WithHTTPClient(http.DefaultClient),
-		WithMessageType(MessageBinary),
+		WithMessageType(MessageText),
 		WithConnectParams(DefaultConnectParams),
+		WithSubprotocols(subprotocols...),
+		WithCompression(CompressionDisabled, 0),
 	}
 	fopts = append(fopts, opts...)
 
@@ -228,20 +785,77 @@ func Dial(ctx context.Context, endpoint string, opts ...DialOption) (*Conn, erro
 		opt.SetDial(dopts)
 	}
 
-	// TODO: Handle resp
-	wc, _, err := dial(ctx, endpoint, dopts)
+	err := dopts.applyTransport()
 	if err != nil {
 		return nil, err
 	}
 
-	return newConn(wc, dopts.typ), nil
+	return dialConn(ctx, endpoint, dopts)
+}
+
+// dialConn establishes a new connection to endpoint with the given options.
+func dialConn(ctx context.Context, endpoint string, dopts *dialOpts) (*Conn, error) {
+	conn, err := connect(ctx, endpoint, dopts)
+	if err != nil {
+		return nil, err
+	}
+
+	if dopts.ackTimeout <= 0 {
+		return conn, nil
+	}
+
+	actx, cancel := context.WithTimeout(ctx, dopts.ackTimeout)
+	defer cancel()
+
+	return conn.handshake(actx)
+}
+
+// connect establishes a new connection to endpoint, without
+// performing the connection_init handshake.
+//
+func connect(ctx context.Context, endpoint string, dopts *dialOpts) (*Conn, error) {
+	initPayload := dopts.initPayload
+	if initPayload == nil && dopts.initParams != nil {
+		b, err := json.Marshal(dopts.initParams)
+		if err != nil {
+			return nil, err
+		}
+		initPayload = b
+	}
+
+	wc, resp, err := dial(ctx, endpoint, dopts)
+	if err != nil {
+		return nil, err
+	}
+
+	if proto := wc.Subprotocol(); proto != "" && !isSupported(proto) {
+		wc.Close(websocket.StatusProtocolError, "unsupported subprotocol")
+		return nil, ErrUnsupportedSubprotocol(proto)
+	}
+
+	conn := newConn(wc, dopts.typ)
+	conn.writeTimeout = dopts.writeTimeout
+	conn.setReadLimit(dopts.readLimit)
+	conn.setMetrics(dopts.metrics)
+	conn.setLogger(dopts.logger)
+	conn.codec = dopts.codec
+	conn.initPayload = initPayload
+	conn.endpoint = endpoint
+	conn.dopts = dopts
+	conn.resp = resp
+	return conn, nil
 }
 
 func dial(ctx context.Context, endpoint string, dopts *dialOpts) (wc *websocket.Conn, resp *http.Response, err error) {
+	header, err := dopts.header(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+
 	opts := &websocket.DialOptions{
 		HTTPClient:           dopts.client,
-		HTTPHeader:           dopts.headers,
-		Subprotocols:         []string{"graphql-ws"},
+		HTTPHeader:           header,
+		Subprotocols:         dopts.subprotocols,
 		CompressionMode:      websocket.CompressionMode(dopts.compression),
 		CompressionThreshold: dopts.threshold,
 	}
@@ -277,36 +891,482 @@ func dial(ctx context.Context, endpoint string, dopts *dialOpts) (wc *websocket.
 	}
 }
 
+// Subprotocol returns the subprotocol negotiated with the peer.
+// An empty string means the peer didn't select one, in which
+// case SubprotocolGraphQLWS is spoken.
+//
+func (c *Conn) Subprotocol() string {
+	return c.proto
+}
+
+// Response returns the HTTP response to the WebSocket handshake e.g. to read
+// cookies or headers set by the server. It returns nil for connections which
+// weren't created with Dial. The response body must not be read.
+//
+func (c *Conn) Response() *http.Response {
+	return c.resp
+}
+
+// AckPayload returns the payload the server sent with its connection_ack
+// e.g. to advertise its capabilities. It returns nil if the server didn't
+// send one or the connection_init handshake hasn't been performed yet, so
+// use WithAckTimeout for the handshake to be performed by Dial.
+//
+// It only covers the handshake performed on this connection. A Client may
+// replace the connection e.g. when it reconnects, so use Client.AckPayload
+// for the payload of its current connection.
+//
+func (c *Conn) AckPayload() json.RawMessage {
+	p, _ := c.ackPayload.Load().(json.RawMessage)
+	return p
+}
+
+// Ping sends a WebSocket ping control frame to the peer and waits for its
+// pong. Unlike Client.Ping, it works with any subprotocol and doesn't
+// interfere with the GraphQL messages, which makes it suitable for
+// health checking idle connections.
+//
+// The pong is only observed while the connection is being read from, e.g.
+// by a Client. If the context is done before the pong is received, the
+// peer is considered unresponsive and the connection is closed.
+//
+func (c *Conn) Ping(ctx context.Context) error {
+	return c.wc.Ping(ctx)
+}
+
+// WriteRaw writes msg to the peer as is e.g. to experiment with server
+// specific protocol extensions. Unlike the messages sent by a Client,
+// its type isn't translated for the negotiated subprotocol.
+//
+// Raw I/O is not supported on a connection which is managed by a Client,
+// since it would interfere with the client's own messages.
+//
+func (c *Conn) WriteRaw(ctx context.Context, msg *RawMessage) error {
+	c.metrics.IncMessage(msg.Type, true)
+	c.logger.Debug("sending message", "type", msg.Type, "id", msg.ID)
+	return c.writeMessage(ctx, msg)
+}
+
+// ReadRaw reads the next message from the peer, without interpreting it.
+//
+// Raw I/O is not supported on a connection which is managed by a Client,
+// since the client reads every message itself.
+//
+func (c *Conn) ReadRaw(ctx context.Context) (*RawMessage, error) {
+	b, err := c.read(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	msg := new(RawMessage)
+	err = unmarshal(c.codec, b, msg)
+	if err != nil {
+		return nil, err
+	}
+	c.received(&operationMessage{ID: msg.ID, Type: reqType(msg.Type)})
+	return msg, nil
+}
+
+// Done returns a channel which is closed once the connection
+// is closed, either by Close or due to an unrecoverable error.
+//
+func (c *Conn) Done() <-chan struct{} {
+	return c.done
+}
+
+// Err returns the error which caused the connection to be closed.
+// It returns nil if the connection is still open or was closed by Close.
+//
+func (c *Conn) Err() error {
+	select {
+	case <-c.done:
+		return c.err
+	default:
+		return nil
+	}
+}
+
+// fail marks the connection as done. Only the first call has any effect.
+func (c *Conn) fail(err error) {
+	c.doneOnce.Do(func() {
+		c.err = err
+		close(c.done)
+		c.logger.Debug("connection closed", "err", err)
+	})
+}
+
+// closed reports whether the read error err was caused by the connection closing.
+func (c *Conn) closed(err error) bool {
+	if websocket.CloseStatus(err) != -1 || errors.Is(err, io.EOF) || errors.Is(err, io.ErrUnexpectedEOF) {
+		return true
+	}
+
+	select {
+	case <-c.done:
+		return true
+	default:
+		return false
+	}
+}
+
+// init performs the connection_init handshake.
+func (c *Conn) init(ctx context.Context) error {
+	msg := operationMessage{Type: gqlConnectionInit}
+	if c.initPayload != nil {
+		msg.Payload = rawPayload(c.initPayload)
+	}
+
+	err := c.write(ctx, msg)
+	if err != nil {
+		return ErrIO{
+			Msg: "failed to send connection_init",
+			Err: err,
+		}
+	}
+
+	b, err := c.read(ctx)
+	if err != nil {
+		return ErrIO{
+			Msg: "failed to receive connection_ack",
+			Err: err,
+		}
+	}
+
+	ackMsg := new(operationMessage)
+	err = ackMsg.unmarshal(c.codec, b)
+	if err != nil {
+		return err
+	}
+	c.received(ackMsg)
+
+	switch ackMsg.Type {
+	case gqlConnectionAck:
+		c.acked = true
+		if p, ok := ackMsg.Payload.(rawPayload); ok {
+			c.ackPayload.Store(json.RawMessage(p))
+		}
+		c.logger.Debug("connection acknowledged")
+		return nil
+	case gqlConnectionError:
+		return asConnectionError(ackMsg)
+	default:
+		return ErrUnexpectedMessage{
+			Expected: string(gqlConnectionAck),
+			Received: string(ackMsg.Type),
+		}
+	}
+}
+
+// handshake performs the connection_init handshake. If the server rejects it,
+// and a WithInitRetry hook is configured, the connection is re-dialed with the
+// refreshed params and the handshake retried once. It returns the connection
+// which completed the handshake, which may not be c. On failure, the
+// connection is closed.
+//
+func (c *Conn) handshake(ctx context.Context) (*Conn, error) {
+	err := c.init(ctx)
+	if err == nil {
+		return c, nil
+	}
+	c.wc.Close(websocket.StatusNormalClosure, "connection_init failed")
+
+	if c.dopts == nil || c.dopts.initRetry == nil || !isRejected(err) {
+		return nil, err
+	}
+	c.logger.Debug("connection rejected, retrying with refreshed params", "err", err)
+
+	params, err := c.dopts.initRetry(ctx, err)
+	if err != nil {
+		return nil, ErrInitRetry{Err: err}
+	}
+	c.dopts.initPayload = params
+
+	conn, err := connect(ctx, c.endpoint, c.dopts)
+	if err != nil {
+		return nil, err
+	}
+
+	err = conn.init(ctx)
+	if err != nil {
+		conn.wc.Close(websocket.StatusNormalClosure, "connection_init failed")
+		return nil, err
+	}
+	return conn, nil
+}
+
+// isRejected reports whether the connection_init handshake failed
+// because the server rejected the connection.
+//
+func isRejected(err error) bool {
+	var connErr *ConnectionError
+	if errors.As(err, &connErr) {
+		return true
+	}
+
+	var closeErr *CloseError
+	return errors.As(err, &closeErr) && (closeErr.code == CloseForbidden || closeErr.code == CloseUnauthorized)
+}
+
+// asConnectionError extracts the error from a connection_error message.
+func asConnectionError(msg *operationMessage) *ConnectionError {
+	cerr, ok := msg.Payload.(*ConnectionError)
+	if !ok {
+		cerr = new(ConnectionError)
+	}
+	return cerr
+}
+
+// redial establishes a new connection to the same endpoint,
+// with the same options, as the one used to create c.
+//
+func (c *Conn) redial(ctx context.Context) (*Conn, error) {
+	return dialConn(ctx, c.endpoint, c.dopts)
+}
+
+// setMetrics configures where measurements are reported, if m is non-nil.
+func (c *Conn) setMetrics(m Metrics) {
+	if m != nil {
+		c.metrics = m
+	}
+}
+
+// setLogger configures where the connection logs to, if l is non-nil.
+func (c *Conn) setLogger(l Logger) {
+	if l != nil {
+		c.logger = l
+	}
+}
+
+// received records a message read from the connection.
+func (c *Conn) received(msg *operationMessage) {
+	c.metrics.IncMessage(string(msg.Type), false)
+	c.logger.Debug("received message", "type", msg.Type, "id", msg.ID)
+}
+
+// setReadLimit configures the maximum message size, if n is positive.
+func (c *Conn) setReadLimit(n int64) {
+	if n <= 0 {
+		return
+	}
+	c.readLimit = n
+
+	// Leave room to detect a message exceeding the limit
+	c.wc.SetReadLimit(n + 1)
+}
+
 func (c *Conn) read(ctx context.Context) ([]byte, error) {
-	_, b, err := c.wc.Read(ctx)
+	b, err := c.readMessage(ctx)
+	if err != nil && websocket.CloseStatus(err) != -1 {
+		atomic.StoreInt32(&c.peerClosed, 1)
+	}
+	var cerr websocket.CloseError
+	switch {
+	case err == nil:
+	case errors.As(err, &cerr):
+		err = &CloseError{code: CloseCode(cerr.Code), reason: cerr.Reason, err: err}
+	case c.closed(err):
+		err = connClosedError{err: err}
+	}
+	if err != nil {
+		// Any read error leaves the underlying connection closed
+		c.fail(err)
+	}
 	return b, err
 }
 
 func (c *Conn) write(ctx context.Context, msg operationMessage) error {
+	c.metrics.IncMessage(string(msg.Type), true)
+	c.logger.Debug("sending message", "type", msg.Type, "id", msg.ID)
+	if c.proto == SubprotocolGraphQLTransportWS {
+		msg = toTransportWS(msg)
+	}
+	return c.writeMessage(ctx, &msg)
+}
+
+// writeMessage encodes v and writes it as a single message.
+func (c *Conn) writeMessage(ctx context.Context, v interface{}) error {
 	buf := c.bufPool.Get().(*bytes.Buffer)
 	defer func() {
 		buf.Reset()
 		c.bufPool.Put(buf)
 	}()
 
-	enc := json.NewEncoder(buf)
-
-	err := enc.Encode(&msg)
+	err := marshal(c.codec, buf, v)
 	if err != nil {
 		return err
 	}
 
-	return c.wc.Write(ctx, c.mtyp, buf.Bytes())
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+
+	wctx := ctx
+	if c.writeTimeout > 0 {
+		var cancel context.CancelFunc
+		wctx, cancel = context.WithTimeout(ctx, c.writeTimeout)
+		defer cancel()
+	}
+
+	err = c.wc.Write(wctx, c.mtyp, buf.Bytes())
+	if err != nil && ctx.Err() == nil && wctx.Err() == context.DeadlineExceeded {
+		err = ErrWriteTimeout
+	}
+	if err != nil {
+		c.fail(err)
+	}
+	return err
 }
 
-// Close closes the underlying WebSocket connection.
-func (c *Conn) Close() error {
-	close(c.done)
+// readMessage reads a single message, while enforcing the read limit.
+func (c *Conn) readMessage(ctx context.Context) ([]byte, error) {
+	if c.readLimit <= 0 {
+		_, b, err := c.wc.Read(ctx)
+		return b, err
+	}
 
-	err := c.write(context.Background(), operationMessage{Type: gqlConnectionTerminate})
+	_, r, err := c.wc.Reader(ctx)
 	if err != nil {
-		return err
+		return nil, err
+	}
+
+	b, err := ioutil.ReadAll(io.LimitReader(r, c.readLimit+1))
+	if err != nil {
+		return nil, err
+	}
+	if int64(len(b)) > c.readLimit {
+		c.wc.Close(websocket.StatusMessageTooBig, "message too big")
+		return nil, ErrMessageTooLarge{Limit: c.readLimit}
 	}
+	return b, nil
+}
+
+// toTransportWS translates a "graphql-ws" message
+// into its "graphql-transport-ws" equivalent.
+//
+func toTransportWS(msg operationMessage) operationMessage {
+	if typ, ok := transportWSTypes[msg.Type]; ok {
+		msg.Type = typ
+	}
+
+	// A decoded "graphql-transport-ws" error e.g. one being forwarded
+	if resp, ok := msg.Payload.(*Response); ok && msg.Type == gqlError {
+		msg.Payload = errorList(resp.Errors)
+		return msg
+	}
+
+	serr, ok := msg.Payload.(*ServerError)
+	if msg.Type != gqlError || !ok {
+		return msg
+	}
+
+	ext := serr.Extensions
+	if serr.Code != "" {
+		ext = make(map[string]interface{}, len(serr.Extensions)+1)
+		for k, v := range serr.Extensions {
+			ext[k] = v
+		}
+		ext["code"] = serr.Code
+	}
+
+	b, err := json.Marshal(struct {
+		Message    string                 `json:"message"`
+		Extensions map[string]interface{} `json:"extensions,omitempty"`
+	}{Message: serr.Msg, Extensions: ext})
+	if err != nil {
+		return msg
+	}
+	msg.Payload = errorList{b}
+	return msg
+}
+
+// defaultCloseTimeout bounds how long Close waits for the connection to
+// be gracefully terminated.
+//
+const defaultCloseTimeout = 5 * time.Second
+
+// ErrCloseTimeout is returned by Close and CloseWithTimeout when the
+// connection couldn't be gracefully terminated in time.
+//
+var ErrCloseTimeout = errors.New("gws: timed out closing connection")
+
+// Close closes the underlying WebSocket connection. It's equivalent
+// to calling CloseWithTimeout with a default timeout of 5 seconds.
+//
+func (c *Conn) Close() error {
+	return c.CloseWithTimeout(defaultCloseTimeout)
+}
+
+// CloseWithTimeout closes the underlying WebSocket connection, while waiting
+// at most timeout for it to be gracefully terminated e.g. if the peer is
+// unresponsive. Once the timeout expires, ErrCloseTimeout is returned and
+// the WebSocket is left to be torn down in the background.
+//
+// It's safe to call repeatedly and concurrently, although only the first
+// call terminates the connection. The others wait for it to return and
+// then return the same result.
+//
+func (c *Conn) CloseWithTimeout(timeout time.Duration) error {
+	c.closeOnce.Do(func() {
+		c.closeErr = c.close(timeout)
+	})
+	return c.closeErr
+}
+
+// close terminates and closes the connection, waiting at most timeout.
+func (c *Conn) close(timeout time.Duration) error {
+	c.fail(nil)
+
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+
+	terminated := make(chan error, 1)
+	go func() {
+		terminated <- c.terminate(ctx)
+	}()
 
-	return c.wc.Close(websocket.StatusNormalClosure, "closed")
+	var err error
+	select {
+	case err = <-terminated:
+	case <-ctx.Done():
+		err = ErrCloseTimeout
+	}
+
+	if err == nil && atomic.LoadInt32(&c.peerClosed) == 1 {
+		// The close handshake has already been completed
+		return nil
+	}
+
+	// Close the WebSocket even if terminating failed, so the
+	// connection isn't leaked.
+	//
+	closed := make(chan error, 1)
+	go func() {
+		closed <- c.wc.Close(websocket.StatusNormalClosure, "closed")
+	}()
+
+	select {
+	case cerr := <-closed:
+		if err == nil {
+			err = cerr
+		}
+	case <-ctx.Done():
+		if err == nil {
+			err = ErrCloseTimeout
+		}
+	}
+	return err
+}
+
+// terminate sends the connection_terminate message, at most once.
+func (c *Conn) terminate(ctx context.Context) error {
+	// "graphql-transport-ws" has no terminate message, instead
+	// the WebSocket is simply closed.
+	//
+	if c.proto == SubprotocolGraphQLTransportWS {
+		return nil
+	}
+
+	c.terminateOnce.Do(func() {
+		c.terminateErr = c.write(ctx, operationMessage{Type: gqlConnectionTerminate})
+	})
+	return c.terminateErr
 }
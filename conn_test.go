@@ -2,10 +2,23 @@ package gws
 
 import (
 	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
+	"io/ioutil"
 	"net"
 	"net/http"
 	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"testing"
 	"time"
 
@@ -49,6 +62,1511 @@ func TestWithDialOptions(t *testing.T) {
 	conn.Close()
 }
 
+func TestWithHeader(t *testing.T) {
+	received := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header
+
+		wc, err := websocket.Accept(w, req, &websocket.AcceptOptions{Subprotocols: []string{"graphql-ws"}})
+		if err != nil {
+			return
+		}
+		wc.CloseRead(context.Background())
+	}))
+	defer srv.Close()
+
+	headers := make(http.Header)
+	headers.Set("X-Tenant", "acme")
+
+	conn, err := Dial(
+		context.Background(),
+		"ws://"+srv.Listener.Addr().String(),
+		WithHeader("Authorization", "Bearer abc"),
+		WithHeaders(headers),
+		WithHeader("X-Tenant", "other"),
+		WithHeader("X-Trace", "123"),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Close()
+
+	h := <-received
+	if h.Get("Authorization") != "Bearer abc" || h.Get("X-Trace") != "123" {
+		t.Logf("unexpected headers: %v", h)
+		t.Fail()
+		return
+	}
+	if tenants := h.Values("X-Tenant"); len(tenants) != 2 || tenants[0] != "acme" || tenants[1] != "other" {
+		t.Logf("expected headers to accumulate, but got: %v", tenants)
+		t.Fail()
+		return
+	}
+	if len(headers.Values("X-Tenant")) != 1 {
+		t.Log("expected the supplied headers not to be modified")
+		t.Fail()
+		return
+	}
+}
+
+func TestWithUserAgent(t *testing.T) {
+	received := make(chan http.Header, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		received <- req.Header
+
+		wc, err := websocket.Accept(w, req, &websocket.AcceptOptions{Subprotocols: []string{"graphql-ws"}})
+		if err != nil {
+			return
+		}
+		wc.CloseRead(context.Background())
+	}))
+	defer srv.Close()
+
+	headers := make(http.Header)
+	headers.Set("User-Agent", "from-headers")
+
+	testCases := []struct {
+		Name      string
+		Opts      []DialOption
+		UserAgent string
+	}{
+		{Name: "Default", UserAgent: defaultUserAgent},
+		{Name: "Headers", Opts: []DialOption{WithHeaders(headers)}, UserAgent: "from-headers"},
+		{Name: "Option", Opts: []DialOption{WithUserAgent("my-app/1.0"), WithHeaders(headers)}, UserAgent: "my-app/1.0"},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), testCase.Opts...)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			conn.Close()
+
+			ua := (<-received).Get("User-Agent")
+			if ua != testCase.UserAgent {
+				subT.Logf("expected User-Agent: %s, but got: %s", testCase.UserAgent, ua)
+				subT.Fail()
+				return
+			}
+		})
+	}
+
+	if !strings.HasPrefix(defaultUserAgent, "graphql-transport-ws-go") {
+		t.Logf("unexpected default User-Agent: %s", defaultUserAgent)
+		t.Fail()
+	}
+}
+
+func TestWithBearerToken(t *testing.T) {
+	var dials int32
+	auths := make(chan string, 2)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		n := atomic.AddInt32(&dials, 1)
+		auths <- req.Header.Get("Authorization")
+
+		wc, err := websocket.Accept(w, req, &websocket.AcceptOptions{Subprotocols: []string{"graphql-ws"}})
+		if err != nil {
+			return
+		}
+		conn := newConn(wc, MessageText)
+
+		conn.read(context.Background())
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+		if n == 1 {
+			// Drop the first connection, after the subscription is started
+			conn.read(context.Background())
+			conn.wc.Close(websocket.StatusGoingAway, "restarting")
+			return
+		}
+		<-conn.wc.CloseRead(context.Background()).Done()
+	}))
+	defer srv.Close()
+
+	t.Run("Static", func(subT *testing.T) {
+		atomic.StoreInt32(&dials, 1)
+
+		conn, err := Dial(
+			context.Background(),
+			"ws://"+srv.Listener.Addr().String(),
+			WithHeader("Authorization", "Basic abc"),
+			WithBearerToken("abc"),
+		)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		conn.Close()
+
+		if auth := <-auths; auth != "Bearer abc" {
+			subT.Logf("expected authorization: %s, but got: %s", "Bearer abc", auth)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Refreshed", func(subT *testing.T) {
+		atomic.StoreInt32(&dials, 0)
+
+		var tokens int32
+		conn, err := Dial(
+			context.Background(),
+			"ws://"+srv.Listener.Addr().String(),
+			WithBearerTokenFunc(func(context.Context) (string, error) {
+				return "token-" + strconv.Itoa(int(atomic.AddInt32(&tokens, 1))), nil
+			}),
+		)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		bc := backoff.Config{BaseDelay: 10 * time.Millisecond, Multiplier: 1.6, MaxDelay: 100 * time.Millisecond}
+		client := NewClient(conn, WithReconnect(bc))
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		defer sub.Unsubscribe()
+
+		for _, want := range []string{"Bearer token-1", "Bearer token-2"} {
+			select {
+			case auth := <-auths:
+				if auth != want {
+					subT.Logf("expected authorization: %s, but got: %s", want, auth)
+					subT.Fail()
+					return
+				}
+			case <-ctx.Done():
+				subT.Log("client never reconnected")
+				subT.Fail()
+				return
+			}
+		}
+	})
+
+	t.Run("Error", func(subT *testing.T) {
+		tokenErr := errors.New("token unavailable")
+		_, err := Dial(
+			context.Background(),
+			"ws://"+srv.Listener.Addr().String(),
+			WithBearerTokenFunc(func(context.Context) (string, error) {
+				return "", tokenErr
+			}),
+		)
+		if err != tokenErr {
+			subT.Logf("expected: %v, but got: %v", tokenErr, err)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestWithOrigin(t *testing.T) {
+	origins := make(chan string, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		origins <- req.Header.Get("Origin")
+
+		wc, err := websocket.Accept(w, req, &websocket.AcceptOptions{
+			Subprotocols:   []string{"graphql-ws"},
+			OriginPatterns: []string{"example.com"},
+		})
+		if err != nil {
+			return
+		}
+		wc.CloseRead(context.Background())
+	}))
+	defer srv.Close()
+
+	headers := make(http.Header)
+	headers.Set("Origin", "https://other.com")
+	headers.Set("Hello", "World")
+
+	conn, err := Dial(
+		context.Background(),
+		"ws://"+srv.Listener.Addr().String(),
+		WithHeaders(headers),
+		WithOrigin("https://example.com"),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	conn.Close()
+
+	if origin := <-origins; origin != "https://example.com" {
+		t.Logf("expected origin: %s, but got: %s", "https://example.com", origin)
+		t.Fail()
+		return
+	}
+	if headers.Get("Origin") != "https://other.com" {
+		t.Log("expected the supplied headers not to be modified")
+		t.Fail()
+		return
+	}
+}
+
+func TestConn_Response(t *testing.T) {
+	aOpts := &websocket.AcceptOptions{
+		Subprotocols: []string{"graphql-ws"},
+	}
+
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		w.Header().Set("X-Correlation-Id", "abc")
+		wc, err := websocket.Accept(w, req, aOpts)
+		if err != nil {
+			t.Fail()
+			return
+		}
+		wc.CloseRead(context.Background())
+	}))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	resp := conn.Response()
+	if resp == nil {
+		t.Log("expected handshake response")
+		t.Fail()
+		return
+	}
+
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Logf("expected status: %d, got: %d", http.StatusSwitchingProtocols, resp.StatusCode)
+		t.Fail()
+		return
+	}
+
+	if id := resp.Header.Get("X-Correlation-Id"); id != "abc" {
+		t.Logf("expected correlation id header but got: %s", id)
+		t.Fail()
+		return
+	}
+}
+
+func TestWithTLSConfig(t *testing.T) {
+	srv := httptest.NewTLSServer(NewHandler(HandlerFunc(errHandler)))
+	defer srv.Close()
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	cfg := &tls.Config{RootCAs: pool}
+
+	endpoint := "wss://" + srv.Listener.Addr().String()
+
+	t.Run("CustomRootCA", func(subT *testing.T) {
+		conn, err := Dial(context.Background(), endpoint, WithTLSConfig(cfg))
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		conn.Close()
+	})
+
+	t.Run("UnknownAuthority", func(subT *testing.T) {
+		_, err := Dial(context.Background(), endpoint)
+		if err == nil {
+			subT.Log("expected dial to fail without the custom root CA")
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("ConflictingTransport", func(subT *testing.T) {
+		_, err := Dial(context.Background(), endpoint, WithHTTPClient(srv.Client()), WithTLSConfig(cfg))
+		if err != ErrConflictingTLSConfig {
+			subT.Logf("expected: %v, got: %v", ErrConflictingTLSConfig, err)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestWithProxy(t *testing.T) {
+	srv := httptest.NewTLSServer(NewHandler(HandlerFunc(testHandler)))
+	defer srv.Close()
+
+	var connects int32
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Method != http.MethodConnect {
+			w.WriteHeader(http.StatusMethodNotAllowed)
+			return
+		}
+		atomic.AddInt32(&connects, 1)
+
+		dst, err := net.Dial("tcp", req.Host)
+		if err != nil {
+			w.WriteHeader(http.StatusBadGateway)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+
+		src, _, err := w.(http.Hijacker).Hijack()
+		if err != nil {
+			dst.Close()
+			return
+		}
+		go func() {
+			defer dst.Close()
+			io.Copy(dst, src)
+		}()
+		go func() {
+			defer src.Close()
+			io.Copy(src, dst)
+		}()
+	}))
+	defer proxy.Close()
+
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	pool := x509.NewCertPool()
+	pool.AddCert(srv.Certificate())
+	cfg := &tls.Config{RootCAs: pool}
+
+	endpoint := "wss://" + srv.Listener.Addr().String()
+
+	t.Run("Connect", func(subT *testing.T) {
+		conn, err := Dial(
+			context.Background(),
+			endpoint,
+			WithHTTPClient(&http.Client{}),
+			WithProxy(http.ProxyURL(proxyURL)),
+			WithTLSConfig(cfg),
+		)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		if n := atomic.LoadInt32(&connects); n != 1 {
+			subT.Logf("expected a single CONNECT but got: %d", n)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("ConflictingTransport", func(subT *testing.T) {
+		_, err := Dial(context.Background(), endpoint, WithHTTPClient(srv.Client()), WithProxy(http.ProxyURL(proxyURL)))
+		if err != ErrConflictingProxy {
+			subT.Logf("expected: %v, got: %v", ErrConflictingProxy, err)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestWithNetDialContext(t *testing.T) {
+	dir, err := ioutil.TempDir("", "gws")
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer os.RemoveAll(dir)
+
+	sock := filepath.Join(dir, "gws.sock")
+	ls, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	srv := httptest.NewUnstartedServer(NewHandler(HandlerFunc(testHandler)))
+	srv.Listener = ls
+	srv.Start()
+	defer srv.Close()
+
+	dial := func(ctx context.Context, _, _ string) (net.Conn, error) {
+		return new(net.Dialer).DialContext(ctx, "unix", sock)
+	}
+
+	t.Run("UnixSocket", func(subT *testing.T) {
+		conn, err := Dial(context.Background(), "ws://unix/graphql", WithNetDialContext(dial))
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+	})
+
+	t.Run("ConflictingTransport", func(subT *testing.T) {
+		client := &http.Client{Transport: &http.Transport{DialContext: dial}}
+
+		_, err := Dial(context.Background(), "ws://unix/graphql", WithHTTPClient(client), WithNetDialContext(dial))
+		if err != ErrConflictingDialer {
+			subT.Logf("expected: %v, got: %v", ErrConflictingDialer, err)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestWithSubprotocols(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Server   []string
+		Client   []string
+		Expected string
+		Err      error
+	}{
+		{
+			Name:     "Default",
+			Server:   []string{SubprotocolGraphQLWS, SubprotocolGraphQLTransportWS},
+			Expected: SubprotocolGraphQLWS,
+		},
+		{
+			Name:     "GraphQLTransportWS",
+			Server:   []string{SubprotocolGraphQLWS, SubprotocolGraphQLTransportWS},
+			Client:   []string{SubprotocolGraphQLTransportWS},
+			Expected: SubprotocolGraphQLTransportWS,
+		},
+		{
+			Name:   "Unsupported",
+			Server: []string{"graphql-unknown"},
+			Client: []string{"graphql-unknown"},
+			Err:    ErrUnsupportedSubprotocol("graphql-unknown"),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			aOpts := &websocket.AcceptOptions{
+				Subprotocols: testCase.Server,
+			}
+
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+				wc, err := websocket.Accept(w, req, aOpts)
+				if err != nil {
+					return
+				}
+				wc.CloseRead(context.Background())
+			}))
+			defer srv.Close()
+
+			var opts []DialOption
+			if testCase.Client != nil {
+				opts = append(opts, WithSubprotocols(testCase.Client...))
+			}
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), opts...)
+			if testCase.Err != nil {
+				if err != testCase.Err {
+					subT.Logf("expected error: %s, but got: %v", testCase.Err, err)
+					subT.Fail()
+				}
+				return
+			}
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			if conn.Subprotocol() != testCase.Expected {
+				subT.Logf("expected subprotocol: %s, but got: %s", testCase.Expected, conn.Subprotocol())
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestWithConnectionParams(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		defer conn.wc.CloseRead(context.Background())
+
+		b, err := conn.read(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		var msg struct {
+			Type    reqType
+			Payload struct {
+				AuthToken string `json:"authToken"`
+			}
+		}
+		err = json.Unmarshal(b, &msg)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if msg.Type != gqlConnectionInit {
+			t.Log("wrong message:", msg)
+			t.Fail()
+			return
+		}
+		if msg.Payload.AuthToken != "test" {
+			t.Logf("expected auth token: %s, but got: %s", "test", msg.Payload.AuthToken)
+			t.Fail()
+			return
+		}
+
+		conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+	})
+	defer srv.Close()
+
+	conn, err := Dial(
+		context.Background(),
+		"ws://"+srv.Listener.Addr().String(),
+		WithConnectionParams(map[string]interface{}{"authToken": "test"}),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	client := NewClient(conn).(*client)
+
+	select {
+	case <-client.ready:
+	case <-client.done:
+		t.Error(client.err)
+	}
+}
+
+func TestWithInitRetry(t *testing.T) {
+	initFunc := func(ctx context.Context, params json.RawMessage) (context.Context, error) {
+		var p struct {
+			Token string `json:"token"`
+		}
+		json.Unmarshal(params, &p)
+		if p.Token != "fresh" {
+			return nil, errors.New("token expired")
+		}
+		return ctx, nil
+	}
+
+	testCases := []struct {
+		Name  string
+		Proto string
+		Opts  []DialOption
+	}{
+		{Name: "GraphQLWS/Dial", Proto: SubprotocolGraphQLWS, Opts: []DialOption{WithAckTimeout(2 * time.Second)}},
+		{Name: "GraphQLWS/Client", Proto: SubprotocolGraphQLWS},
+		{Name: "GraphQLTransportWS/Dial", Proto: SubprotocolGraphQLTransportWS, Opts: []DialOption{WithAckTimeout(2 * time.Second)}},
+		{Name: "GraphQLTransportWS/Client", Proto: SubprotocolGraphQLTransportWS},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := httptest.NewServer(NewHandler(
+				HandlerFunc(testHandler),
+				WithConnectionInitFunc(initFunc),
+				WithServerSubprotocols(testCase.Proto),
+			))
+			defer srv.Close()
+
+			var prevErrs []error
+			opts := append([]DialOption{
+				WithConnectionParams(map[string]interface{}{"token": "stale"}),
+				WithInitRetry(func(ctx context.Context, prevErr error) (json.RawMessage, error) {
+					prevErrs = append(prevErrs, prevErr)
+					return json.RawMessage(`{"token":"fresh"}`), nil
+				}),
+			}, testCase.Opts...)
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), opts...)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			client := NewClient(conn)
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			if len(prevErrs) != 1 || !isRejected(prevErrs[0]) {
+				subT.Logf("expected the hook to be called once with the rejection, but got: %v", prevErrs)
+				subT.Fail()
+				return
+			}
+		})
+	}
+
+	t.Run("HookError", func(subT *testing.T) {
+		srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler), WithConnectionInitFunc(initFunc)))
+		defer srv.Close()
+
+		refreshErr := errors.New("refresh token revoked")
+		_, err := Dial(
+			context.Background(),
+			"ws://"+srv.Listener.Addr().String(),
+			WithAckTimeout(2*time.Second),
+			WithInitRetry(func(ctx context.Context, prevErr error) (json.RawMessage, error) {
+				return nil, refreshErr
+			}),
+		)
+
+		var retryErr ErrInitRetry
+		if !errors.As(err, &retryErr) || !errors.Is(err, refreshErr) {
+			subT.Logf("unexpected error: %v", err)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestConn_AckPayload(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Ack     string
+		Payload string
+	}{
+		{
+			Name:    "Payload",
+			Ack:     `{"type":"connection_ack","payload":{"capabilities":["defer"],"sessionId":"abc"}}`,
+			Payload: `{"capabilities":["defer"],"sessionId":"abc"}`,
+		},
+		{
+			Name: "NoPayload",
+			Ack:  `{"type":"connection_ack"}`,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := newTestServer(func(conn *Conn) {
+				conn.read(context.Background())
+				conn.wc.Write(context.Background(), websocket.MessageText, []byte(testCase.Ack))
+				<-conn.wc.CloseRead(context.Background()).Done()
+			})
+			defer srv.Close()
+
+			conn, err := Dial(
+				context.Background(),
+				"ws://"+srv.Listener.Addr().String(),
+				WithAckTimeout(time.Second),
+			)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			if string(conn.AckPayload()) != testCase.Payload {
+				subT.Logf("expected ack payload: %s, but got: %s", testCase.Payload, string(conn.AckPayload()))
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestClient_AckPayload(t *testing.T) {
+	var dials int32
+	srv := newTestServer(func(conn *Conn) {
+		n := atomic.AddInt32(&dials, 1)
+
+		conn.read(context.Background())
+		ack := fmt.Sprintf(`{"type":"connection_ack","payload":{"session":%d}}`, n)
+		conn.wc.Write(context.Background(), websocket.MessageText, []byte(ack))
+
+		if n == 1 {
+			// Force the client to reconnect
+			conn.wc.Close(websocket.StatusGoingAway, "restarting")
+			return
+		}
+		<-conn.wc.CloseRead(context.Background()).Done()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	// Read the payloads while the client performs the handshakes
+	done := make(chan struct{})
+	defer func() { <-done }()
+	go func() {
+		defer close(done)
+		for ctx.Err() == nil {
+			conn.AckPayload()
+			time.Sleep(time.Millisecond)
+		}
+	}()
+
+	bc := backoff.Config{BaseDelay: 10 * time.Millisecond, Multiplier: 1.6, MaxDelay: 100 * time.Millisecond}
+	client := NewClient(conn, WithReconnect(bc))
+	defer client.Close()
+	defer cancel()
+
+	for string(client.AckPayload()) != `{"session":2}` {
+		select {
+		case <-ctx.Done():
+			t.Logf("expected the payload of the second connection, but got: %s", string(client.AckPayload()))
+			t.Fail()
+			return
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	if string(conn.AckPayload()) != `{"session":1}` {
+		t.Logf("expected the dialed connection to keep its own payload, but got: %s", string(conn.AckPayload()))
+		t.Fail()
+		return
+	}
+}
+
+func TestWithAckTimeout(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Handler func(*Conn)
+		Check   func(error) bool
+	}{
+		{
+			Name: "Ack",
+			Handler: func(conn *Conn) {
+				conn.read(context.Background())
+				conn.wc.CloseRead(context.Background())
+				conn.write(context.Background(), operationMessage{Type: gqlConnectionAck})
+			},
+			Check: func(err error) bool { return err == nil },
+		},
+		{
+			Name: "ConnectionError",
+			Handler: func(conn *Conn) {
+				conn.read(context.Background())
+				conn.wc.CloseRead(context.Background())
+				conn.wc.Write(context.Background(), websocket.MessageBinary, []byte(`{"type":"connection_error","payload":{"message":"unauthorized"}}`))
+			},
+			Check: func(err error) bool {
+				var cerr *ConnectionError
+				return errors.As(err, &cerr) && string(cerr.Payload) == `{"message":"unauthorized"}`
+			},
+		},
+		{
+			Name: "Timeout",
+			Handler: func(conn *Conn) {
+				conn.read(context.Background())
+				conn.wc.CloseRead(context.Background())
+			},
+			Check: func(err error) bool { return errors.Is(err, context.DeadlineExceeded) },
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := newTestServer(testCase.Handler)
+			defer srv.Close()
+
+			conn, err := Dial(
+				context.Background(),
+				"ws://"+srv.Listener.Addr().String(),
+				WithAckTimeout(500*time.Millisecond),
+			)
+			if !testCase.Check(err) {
+				subT.Logf("unexpected error: %v", err)
+				subT.Fail()
+				return
+			}
+			if err != nil {
+				return
+			}
+			defer conn.Close()
+
+			if !conn.acked {
+				subT.Log("expected connection to be acknowledged")
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestWithWriteTimeout(t *testing.T) {
+	stalled := make(chan struct{})
+	srv := newTestServer(func(conn *Conn) {
+		// Never read, so the client eventually blocks on writing
+		<-stalled
+	})
+	defer srv.Close()
+	defer close(stalled)
+
+	// Shrink the socket buffers so writes block sooner
+	client := &http.Client{
+		Transport: &http.Transport{
+			DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+				conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+				if err != nil {
+					return nil, err
+				}
+				conn.(*net.TCPConn).SetWriteBuffer(4096)
+				return conn, nil
+			},
+		},
+	}
+
+	conn, err := Dial(
+		context.Background(),
+		"ws://"+srv.Listener.Addr().String(),
+		WithHTTPClient(client),
+		WithWriteTimeout(50*time.Millisecond),
+	)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	req := &Request{Query: strings.Repeat("a", 1<<20)}
+	for i := 0; i < 1000; i++ {
+		err = conn.write(context.Background(), operationMessage{ID: "1", Type: gqlStart, Payload: req})
+		if err != nil {
+			break
+		}
+	}
+
+	if err != ErrWriteTimeout {
+		t.Logf("expected: %s, but got: %v", ErrWriteTimeout, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestConn_Done(t *testing.T) {
+	t.Run("Close", func(subT *testing.T) {
+		srv := newTestServer(func(conn *Conn) {
+			<-conn.wc.CloseRead(context.Background()).Done()
+		})
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		select {
+		case <-conn.Done():
+			subT.Log("connection was done before being closed")
+			subT.Fail()
+			return
+		default:
+		}
+
+		conn.Close()
+
+		select {
+		case <-conn.Done():
+		default:
+			subT.Log("connection was not done after being closed")
+			subT.Fail()
+			return
+		}
+		if conn.Err() != nil {
+			subT.Logf("expected no error but got: %s", conn.Err())
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("PeerClosed", func(subT *testing.T) {
+		srv := newTestServer(func(conn *Conn) {
+			conn.wc.Close(websocket.StatusGoingAway, "shutting down")
+		})
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		defer conn.Close()
+
+		go conn.read(context.Background())
+
+		select {
+		case <-conn.Done():
+		case <-time.After(2 * time.Second):
+			subT.Log("connection was never done")
+			subT.Fail()
+			return
+		}
+		if websocket.CloseStatus(conn.Err()) != websocket.StatusGoingAway {
+			subT.Logf("expected close error but got: %v", conn.Err())
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestConn_RawIO(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		msg, err := conn.ReadRaw(ctx)
+		if err != nil {
+			return
+		}
+		conn.WriteRaw(ctx, &RawMessage{ID: msg.ID, Type: "x-echo", Payload: msg.Payload})
+		<-conn.wc.CloseRead(ctx).Done()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err = conn.WriteRaw(ctx, &RawMessage{ID: "1", Type: "x-custom", Payload: json.RawMessage(`{"hello":"world"}`)})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	msg, err := conn.ReadRaw(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if msg.ID != "1" || msg.Type != "x-echo" || string(msg.Payload) != `{"hello":"world"}` {
+		t.Logf("unexpected message: %v", msg)
+		t.Fail()
+		return
+	}
+}
+
+func TestConn_Ping(t *testing.T) {
+	t.Run("Pong", func(subT *testing.T) {
+		srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler), WithServerSubprotocols(SubprotocolGraphQLTransportWS)))
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		// The client reads from the connection, so the pong is observed
+		client := NewClient(conn)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+		defer cancel()
+
+		err = conn.Ping(ctx)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+	})
+
+	t.Run("Unresponsive", func(subT *testing.T) {
+		stalled := make(chan struct{})
+		srv := newTestServer(func(conn *Conn) {
+			// Never read, so the ping is never answered
+			<-stalled
+		})
+		defer srv.Close()
+		defer close(stalled)
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		go conn.read(context.Background())
+
+		ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+		defer cancel()
+
+		err = conn.Ping(ctx)
+		if !errors.Is(err, context.DeadlineExceeded) {
+			subT.Logf("expected: %s, but got: %v", context.DeadlineExceeded, err)
+			subT.Fail()
+			return
+		}
+
+		select {
+		case <-conn.Done():
+		case <-time.After(2 * time.Second):
+			subT.Log("expected the unresponsive connection to be closed")
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestWithMessageType(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Opts     []DialOption
+		Expected websocket.MessageType
+	}{
+		{
+			Name:     "Default",
+			Expected: websocket.MessageText,
+		},
+		{
+			Name:     "Binary",
+			Opts:     []DialOption{WithMessageType(MessageBinary)},
+			Expected: websocket.MessageBinary,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			typs := make(chan websocket.MessageType, 1)
+			srv := newTestServer(func(conn *Conn) {
+				typ, _, _ := conn.wc.Read(context.Background())
+				typs <- typ
+				conn.wc.Close(websocket.StatusNormalClosure, "closed")
+			})
+			defer srv.Close()
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), testCase.Opts...)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			err = conn.write(context.Background(), operationMessage{Type: gqlConnectionInit})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			typ := <-typs
+			if typ != testCase.Expected {
+				subT.Logf("expected message type: %s, but got: %s", testCase.Expected, typ)
+				subT.Fail()
+				return
+			}
+		})
+	}
+
+	t.Run("Mixed", func(subT *testing.T) {
+		srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler), WithMessageType(MessageBinary)))
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), WithMessageType(MessageText))
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+	})
+}
+
+// frameRecorder records the first byte of the last WebSocket frame
+// written and counts the bytes read.
+type frameRecorder struct {
+	net.Conn
+
+	mu     sync.Mutex
+	header byte
+	read   int
+}
+
+func (c *frameRecorder) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	c.read += n
+	c.mu.Unlock()
+	return n, err
+}
+
+// bytesRead returns the number of bytes read.
+func (c *frameRecorder) bytesRead() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.read
+}
+
+func (c *frameRecorder) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	c.header = b[0]
+	c.mu.Unlock()
+	return c.Conn.Write(b)
+}
+
+// compressed reports whether the RSV1 bit, which marks
+// compressed messages, was set on the last frame written.
+func (c *frameRecorder) compressed() bool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.header&0x40 != 0
+}
+
+func TestWithCompression_Threshold(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		Threshold  int
+		Size       int
+		Compressed bool
+	}{
+		{
+			Name:      "BelowThreshold",
+			Threshold: 256,
+			Size:      128,
+		},
+		{
+			Name:       "AboveThreshold",
+			Threshold:  256,
+			Size:       1024,
+			Compressed: true,
+		},
+		{
+			Name:      "NegativeUsesDefault",
+			Threshold: -1,
+			Size:      256,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := newTestServer(func(conn *Conn) {
+				<-conn.wc.CloseRead(context.Background()).Done()
+			})
+			defer srv.Close()
+
+			var rec *frameRecorder
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+						if err != nil {
+							return nil, err
+						}
+						rec = &frameRecorder{Conn: conn}
+						return rec, nil
+					},
+				},
+			}
+
+			conn, err := Dial(
+				context.Background(),
+				"ws://"+srv.Listener.Addr().String(),
+				WithHTTPClient(client),
+				WithCompression(CompressionNoContextTakeover, testCase.Threshold),
+			)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			defer conn.Close()
+
+			query := strings.Repeat("a", testCase.Size)
+			err = conn.wc.Write(context.Background(), websocket.MessageText, []byte(query))
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			if rec.compressed() != testCase.Compressed {
+				subT.Logf("expected compressed: %v, but got: %v", testCase.Compressed, rec.compressed())
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestWithReadLimit(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		defer conn.wc.CloseRead(context.Background())
+
+		conn.write(context.Background(), operationMessage{
+			ID:      "1",
+			Type:    gqlData,
+			Payload: &Response{Data: []byte(strconv.Quote(strings.Repeat("a", 128)))},
+		})
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), WithReadLimit(64))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	_, err = conn.read(ctx)
+
+	var limitErr ErrMessageTooLarge
+	if !errors.As(err, &limitErr) {
+		t.Logf("expected: ErrMessageTooLarge, but got: %v", err)
+		t.Fail()
+		return
+	}
+	if limitErr.Limit != 64 {
+		t.Logf("expected limit: %d, but got: %d", 64, limitErr.Limit)
+		t.Fail()
+		return
+	}
+}
+
+func TestConcurrentWrites(t *testing.T) {
+	const n = 100
+
+	received := make(chan int, 1)
+	srv := newTestServer(func(conn *Conn) {
+		defer conn.wc.CloseRead(context.Background())
+		defer close(received)
+
+		var count int
+		for count < n {
+			b, err := conn.read(context.Background())
+			if err != nil {
+				t.Error(err)
+				return
+			}
+
+			msg := new(operationMessage)
+			err = msg.UnmarshalJSON(b)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			count++
+		}
+		received <- count
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+
+		go func(i int) {
+			defer wg.Done()
+
+			err := conn.write(context.Background(), operationMessage{
+				ID:      OperationID(strconv.Itoa(i)),
+				Type:    gqlStart,
+				Payload: &Request{Query: "{ hello { world } }"},
+			})
+			if err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	count := <-received
+	if count != n {
+		t.Logf("expected %d messages, but got: %d", n, count)
+		t.Fail()
+		return
+	}
+}
+
+func TestToTransportWS_ServerError(t *testing.T) {
+	msg := toTransportWS(operationMessage{
+		ID:   "1",
+		Type: gqlError,
+		Payload: &ServerError{
+			Msg:        "rate limited",
+			Code:       "RATE_LIMITED",
+			Extensions: map[string]interface{}{"retryAfter": 30},
+		},
+	})
+
+	errs, ok := msg.Payload.(errorList)
+	if !ok || len(errs) != 1 {
+		t.Logf("expected a single error but got: %v", msg.Payload)
+		t.Fail()
+		return
+	}
+
+	var gerr GraphQLError
+	err := json.Unmarshal(errs[0], &gerr)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if gerr.Message != "rate limited" || gerr.Extensions["code"] != "RATE_LIMITED" || gerr.Extensions["retryAfter"] != float64(30) {
+		t.Logf("unexpected error: %s", string(errs[0]))
+		t.Fail()
+		return
+	}
+}
+
+func TestToTransportWS_ErrorList(t *testing.T) {
+	var in operationMessage
+	err := in.UnmarshalJSON([]byte(`{"id":"1","type":"error","payload":[{"message":"invalid"}]}`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	b, err := json.Marshal(toTransportWS(in))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	ex := `{"id":"1","type":"error","payload":[{"message":"invalid"}]}`
+	if string(b) != ex {
+		t.Logf("expected: %s, but got: %s", ex, string(b))
+		t.Fail()
+		return
+	}
+}
+
+func TestConn_CloseWithTimeout(t *testing.T) {
+	t.Run("UnresponsivePeer", func(subT *testing.T) {
+		stalled := make(chan struct{})
+		srv := newTestServer(func(conn *Conn) {
+			// Never read, so the close handshake is never completed
+			<-stalled
+		})
+		defer srv.Close()
+		defer close(stalled)
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		start := time.Now()
+		err = conn.CloseWithTimeout(100 * time.Millisecond)
+		if err != ErrCloseTimeout {
+			subT.Logf("expected: %s, but got: %v", ErrCloseTimeout, err)
+			subT.Fail()
+			return
+		}
+		if d := time.Since(start); d > time.Second {
+			subT.Logf("expected close to be bounded by its timeout, but took: %s", d)
+			subT.Fail()
+			return
+		}
+
+		select {
+		case <-conn.Done():
+		default:
+			subT.Log("connection was not done after being closed")
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Concurrent", func(subT *testing.T) {
+		srv := newTestServer(func(conn *Conn) {
+			<-conn.wc.CloseRead(context.Background()).Done()
+		})
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		var wg sync.WaitGroup
+		for i := 0; i < 10; i++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				conn.Close()
+			}()
+		}
+		wg.Wait()
+
+		if conn.Err() != nil {
+			subT.Logf("expected no error but got: %s", conn.Err())
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestConn_CloseTwice(t *testing.T) {
+	srv := newTestServer(func(conn *Conn) {
+		<-conn.wc.CloseRead(context.Background()).Done()
+	})
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	first := conn.Close()
+	second := conn.Close()
+	if first != second {
+		t.Logf("expected repeated close to return: %v, but got: %v", first, second)
+		t.Fail()
+		return
+	}
+}
+
 func TestTerminate(t *testing.T) {
 	srv := newTestServer(func(conn *Conn) {
 		defer conn.wc.CloseRead(context.Background())
@@ -4,6 +4,8 @@ import (
 	"context"
 	"encoding/json"
 	"net/http/httptest"
+	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -96,6 +98,68 @@ func TestE2E_Subscription(t *testing.T) {
 	}
 }
 
+func TestE2E_GraphQLTransportWS(t *testing.T) {
+	h := NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		if req.Query == "" {
+			return errHandler(s, req)
+		}
+		return testHandler(s, req)
+	})).(*handler)
+	h.wcOptions.Subprotocols = []string{SubprotocolGraphQLTransportWS}
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Errorf("unexpected error when dialing: %s", err)
+		return
+	}
+	defer conn.Close()
+
+	if conn.Subprotocol() != SubprotocolGraphQLTransportWS {
+		t.Logf("expected subprotocol: %s, but got: %s", SubprotocolGraphQLTransportWS, conn.Subprotocol())
+		t.Fail()
+		return
+	}
+
+	client := NewClient(conn, WithAllowEmptyQuery())
+	resp, err := client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+	if err != nil {
+		t.Errorf("unexpected error when querying: %s", err)
+		return
+	}
+
+	var testResp struct {
+		Hello struct {
+			World string
+		}
+	}
+	err = json.Unmarshal(resp.Data, &testResp)
+	if err != nil {
+		t.Logf("response data: %s", string(resp.Data))
+		t.Errorf("unexpected error when unmarshalling response: %s", err)
+		return
+	}
+
+	if testResp.Hello.World != "this is a test" {
+		t.Logf("expected: %s, but got: %s", "this is a test", testResp.Hello.World)
+		t.Fail()
+		return
+	}
+
+	resp, err = client.Query(context.Background(), &Request{})
+	if err != nil {
+		t.Errorf("unexpected error when querying: %s", err)
+		return
+	}
+	if len(resp.Errors) != 1 {
+		t.Logf("expected a single error but got: %d", len(resp.Errors))
+		t.Fail()
+		return
+	}
+}
+
 func TestConcurrency(t *testing.T) {
 	srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler)))
 	defer srv.Close()
@@ -149,6 +213,184 @@ func TestConcurrency(t *testing.T) {
 	wg.Wait()
 }
 
+func TestConcurrency_Routing(t *testing.T) {
+	// Echo the operation name back, so responses can be matched to their operation
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		n := 1
+		if strings.HasPrefix(req.Query, "subscription") {
+			n = 3
+		}
+		for i := 0; i < n; i++ {
+			err := s.Send(context.TODO(), &Response{Data: []byte(strconv.Quote(req.OperationName))})
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Errorf("unexpected error when dialing: %s", err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 100; i++ {
+		wg.Add(2)
+
+		go func(name string) {
+			defer wg.Done()
+
+			resp, err := client.Query(ctx, &Request{Query: "{ hello }", OperationName: name})
+			if err != nil {
+				t.Errorf("unexpected error when querying: %s", err)
+				return
+			}
+			if string(resp.Data) != strconv.Quote(name) {
+				t.Logf("expected: %s, but got: %s", name, string(resp.Data))
+				t.Fail()
+			}
+		}("query" + strconv.Itoa(i))
+
+		go func(name string) {
+			defer wg.Done()
+
+			sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }", OperationName: name})
+			if err != nil {
+				t.Errorf("unexpected error when subscribing: %s", err)
+				return
+			}
+			defer sub.Unsubscribe()
+
+			for j := 0; j < 3; j++ {
+				resp, err := sub.Recv(ctx)
+				if err != nil {
+					t.Errorf("unexpected error when receiving: %s", err)
+					return
+				}
+				if string(resp.Data) != strconv.Quote(name) {
+					t.Logf("expected: %s, but got: %s", name, string(resp.Data))
+					t.Fail()
+					return
+				}
+			}
+
+			_, err = sub.Recv(ctx)
+			if err != ErrUnsubscribed {
+				t.Logf("expected: %s, but got: %v", ErrUnsubscribed, err)
+				t.Fail()
+			}
+		}("subscription" + strconv.Itoa(i))
+	}
+	wg.Wait()
+}
+
+func TestConcurrency_StreamingSubscription(t *testing.T) {
+	// The subscription streams its own id, until stopped, while each
+	// query echos its operation name, so any cross-talk is detected.
+	//
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		if !strings.HasPrefix(req.Query, "subscription") {
+			return s.Send(context.TODO(), &Response{Data: []byte(strconv.Quote(req.OperationName))})
+		}
+
+		resp := &Response{Data: []byte(strconv.Quote(string(s.ID())))}
+		for s.Context().Err() == nil {
+			err := s.Send(s.Context(), resp)
+			if err != nil {
+				return nil
+			}
+			time.Sleep(time.Millisecond)
+		}
+		return nil
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Errorf("unexpected error when dialing: %s", err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { ticks }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	received := make(chan int, 1)
+	go func() {
+		var n int
+		defer func() { received <- n }()
+
+		for {
+			resp, err := sub.Recv(ctx)
+			if err != nil {
+				return
+			}
+			if string(resp.Data) != strconv.Quote(string(sub.ID())) {
+				t.Logf("subscription %s received: %s", sub.ID(), string(resp.Data))
+				t.Fail()
+				return
+			}
+			n++
+		}
+	}()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 50; i++ {
+		wg.Add(1)
+
+		go func(name string) {
+			defer wg.Done()
+
+			resp, err := client.Query(ctx, &Request{Query: "{ hello }", OperationName: name})
+			if err != nil {
+				t.Errorf("unexpected error when querying: %s", err)
+				return
+			}
+			if string(resp.Data) != strconv.Quote(name) {
+				t.Logf("expected: %s, but got: %s", name, string(resp.Data))
+				t.Fail()
+			}
+		}("query" + strconv.Itoa(i))
+	}
+	wg.Wait()
+
+	sub.Unsubscribe()
+	if n := <-received; n == 0 {
+		t.Log("expected the subscription to have received responses")
+		t.Fail()
+		return
+	}
+
+	// Every operation ends, including the subscription once stopped
+	err = client.Wait(ctx)
+	if err != nil {
+		t.Logf("expected no active operations, but got: %v: %v", client.ActiveOperations(), err)
+		t.Fail()
+		return
+	}
+}
+
 func BenchmarkE2E(b *testing.B) {
 	srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler)))
 	defer srv.Close()
@@ -172,3 +414,43 @@ func BenchmarkE2E(b *testing.B) {
 		}
 	})
 }
+
+func BenchmarkE2E_SubscriptionThroughput(b *testing.B) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		n, _ := strconv.Atoi(req.OperationName)
+		resp := &Response{Data: []byte(`{"tick":1}`)}
+		for i := 0; i < n; i++ {
+			err := s.Send(s.Context(), resp)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+
+	b.ResetTimer()
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { tick }", OperationName: strconv.Itoa(b.N)})
+	if err != nil {
+		b.Fatal(err)
+	}
+	for i := 0; i < b.N; i++ {
+		_, err = sub.Recv(ctx)
+		if err != nil {
+			b.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,108 @@
+// Package gwstest provides utilities for testing GraphQL over WebSocket clients.
+//
+// It is similar to net/http/httptest, in that it starts a real server, but
+// the server replies to each request with a scripted set of responses.
+//
+package gwstest
+
+import (
+	"errors"
+	"net/http/httptest"
+	"strings"
+	"sync"
+
+	"github.com/zaba505/gws"
+)
+
+// ErrNoReply is returned to the client when a request
+// is received which no reply has been scripted for.
+//
+var ErrNoReply = errors.New("gwstest: no reply scripted for query")
+
+type reply struct {
+	resps []*gws.Response
+	err   error
+}
+
+// Server is a GraphQL over WebSocket server, which listens
+// on a system-chosen port on the local loopback interface.
+//
+type Server struct {
+	*httptest.Server
+
+	// URL is the WebSocket url of the form ws://ipaddr:port,
+	// which can be directly passed to gws.Dial.
+	//
+	URL string
+
+	mu      sync.Mutex
+	replies map[string]reply
+	reqs    []*gws.Request
+}
+
+// NewServer starts and returns a new Server.
+// The caller should call Close when finished, to shut it down.
+//
+func NewServer(opts ...gws.ServerOption) *Server {
+	s := &Server{
+		replies: make(map[string]reply),
+	}
+
+	s.Server = httptest.NewServer(gws.NewHandler(gws.HandlerFunc(s.serveGraphQL), opts...))
+	s.URL = "ws" + strings.TrimPrefix(s.Server.URL, "http")
+	return s
+}
+
+// On scripts the server to reply to any request for the given query with the
+// given responses, in order, and then complete the operation.
+//
+func (s *Server) On(query string, resps ...*gws.Response) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replies[query] = reply{resps: resps}
+}
+
+// OnError scripts the server to fail any request for the given query with err.
+func (s *Server) OnError(query string, err error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	s.replies[query] = reply{err: err}
+}
+
+// Requests returns all requests received by the server, in the order received.
+func (s *Server) Requests() []*gws.Request {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	reqs := make([]*gws.Request, len(s.reqs))
+	copy(reqs, s.reqs)
+	return reqs
+}
+
+func (s *Server) serveGraphQL(stream *gws.Stream, req *gws.Request) error {
+	s.mu.Lock()
+	s.reqs = append(s.reqs, req)
+	r, ok := s.replies[req.Query]
+	s.mu.Unlock()
+
+	if !ok {
+		return ErrNoReply
+	}
+	if r.err != nil {
+		return r.err
+	}
+
+	for _, resp := range r.resps {
+		err := stream.Send(stream.Context(), resp)
+		if err == gws.ErrStreamClosed {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+	stream.Close()
+	return nil
+}
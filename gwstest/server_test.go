@@ -0,0 +1,87 @@
+package gwstest
+
+import (
+	"context"
+	"encoding/json"
+	"testing"
+	"time"
+
+	"github.com/zaba505/gws"
+)
+
+func TestServer_On(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	srv.On("subscription { hello }",
+		&gws.Response{Data: json.RawMessage(`{"hello":"a"}`)},
+		&gws.Response{Data: json.RawMessage(`{"hello":"b"}`)},
+	)
+
+	conn, err := gws.Dial(context.Background(), srv.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client := gws.NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	sub, err := client.Subscribe(ctx, &gws.Request{Query: "subscription { hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, want := range []string{`{"hello":"a"}`, `{"hello":"b"}`} {
+		resp, err := sub.Recv(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(resp.Data) != want {
+			t.Logf("expected: %s, got: %s", want, resp.Data)
+			t.Fail()
+			return
+		}
+	}
+
+	_, err = sub.Recv(ctx)
+	if err != gws.ErrUnsubscribed {
+		t.Logf("expected subscription to complete but got: %v", err)
+		t.Fail()
+		return
+	}
+
+	reqs := srv.Requests()
+	if len(reqs) != 1 || reqs[0].Query != "subscription { hello }" {
+		t.Logf("unexpected requests: %v", reqs)
+		t.Fail()
+		return
+	}
+}
+
+func TestServer_NoReply(t *testing.T) {
+	srv := NewServer()
+	defer srv.Close()
+
+	conn, err := gws.Dial(context.Background(), srv.URL)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	client := gws.NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.Query(ctx, &gws.Request{Query: "{ hello }"})
+	if err == nil {
+		t.Log("expected an error")
+		t.Fail()
+		return
+	}
+}
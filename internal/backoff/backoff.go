@@ -27,7 +27,6 @@ import (
 	"time"
 
 	gwsbackoff "github.com/zaba505/gws/backoff"
-	"github.com/zaba505/gws/internal/rand"
 )
 
 // Strategy defines the methodology for backing off after a grpc connection
@@ -53,22 +52,5 @@ type Exponential struct {
 // Backoff returns the amount of time to wait before the next retry given the
 // number of retries.
 func (bc Exponential) Backoff(retries int) time.Duration {
-	if retries == 0 {
-		return bc.Config.BaseDelay
-	}
-	backoff, max := float64(bc.Config.BaseDelay), float64(bc.Config.MaxDelay)
-	for backoff < max && retries > 0 {
-		backoff *= bc.Config.Multiplier
-		retries--
-	}
-	if backoff > max {
-		backoff = max
-	}
-	// Randomize backoff delays so that if a cluster of requests start at
-	// the same time, they won't operate in lockstep.
-	backoff *= 1 + bc.Config.Jitter*(rand.Float64()*2-1)
-	if backoff < 0 {
-		return 0
-	}
-	return time.Duration(backoff)
+	return bc.Config.Backoff(retries)
 }
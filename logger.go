@@ -0,0 +1,32 @@
+package gws
+
+// Logger is used to log the messages exchanged over a connection,
+// handshake transitions and errors, which is helpful for debugging
+// protocol issues. kv is a list of alternating keys and values.
+//
+type Logger interface {
+	Debug(msg string, kv ...interface{})
+}
+
+type nopLogger struct{}
+
+func (nopLogger) Debug(string, ...interface{}) {}
+
+type loggerOpt struct {
+	l Logger
+}
+
+func (o loggerOpt) SetDial(opts *dialOpts) {
+	opts.logger = o.l
+}
+
+func (o loggerOpt) SetServer(opts *options) {
+	opts.logger = o.l
+}
+
+// WithLogger configures where the connection logs to.
+// By default, nothing is logged.
+//
+func WithLogger(l Logger) ConnOption {
+	return loggerOpt{l: l}
+}
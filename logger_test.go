@@ -0,0 +1,62 @@
+package gws
+
+import (
+	"context"
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testLogger struct {
+	mu   sync.Mutex
+	logs []string
+}
+
+func (l *testLogger) Debug(msg string, kv ...interface{}) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	l.logs = append(l.logs, fmt.Sprintln(append([]interface{}{msg}, kv...)...))
+}
+
+func TestWithLogger(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(errHandler)))
+	defer srv.Close()
+
+	l := new(testLogger)
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), WithLogger(l))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	client.Query(ctx, &Request{Query: "{ hello }"})
+	client.Close()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	logs := strings.Join(l.logs, "\n")
+
+	expected := []string{
+		"sending message type connection_init",
+		"received message type connection_ack",
+		"connection acknowledged",
+		"sending message type start",
+		"received message type error",
+		"connection closed",
+	}
+	for _, exp := range expected {
+		if !strings.Contains(logs, exp) {
+			t.Logf("expected logs to contain: %s\n%s", exp, logs)
+			t.Fail()
+			return
+		}
+	}
+}
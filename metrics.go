@@ -0,0 +1,56 @@
+package gws
+
+import "time"
+
+// Metrics receives measurements from clients and servers, so they can be
+// exported to a monitoring system e.g. Prometheus, without this package
+// depending on a specific metrics library.
+//
+// Implementations must be safe for concurrent use.
+//
+type Metrics interface {
+	// IncMessage is called for every message sent or received. Message
+	// types are always reported using their "graphql-ws" names e.g. start,
+	// regardless of the negotiated subprotocol.
+	//
+	IncMessage(typ string, sent bool)
+
+	// AddSubscriptions is called with +1 when a client starts a
+	// subscription and -1 once the subscription ends.
+	//
+	AddSubscriptions(delta int)
+
+	// ObserveQuery is called once a client query or mutation completes.
+	ObserveQuery(d time.Duration, err error)
+}
+
+// NopMetrics discards all measurements. It may be embedded by
+// implementations which are only interested in some of them.
+//
+type NopMetrics struct{}
+
+// IncMessage implements the Metrics interface.
+func (NopMetrics) IncMessage(string, bool) {}
+
+// AddSubscriptions implements the Metrics interface.
+func (NopMetrics) AddSubscriptions(int) {}
+
+// ObserveQuery implements the Metrics interface.
+func (NopMetrics) ObserveQuery(time.Duration, error) {}
+
+type metricsOpt struct {
+	m Metrics
+}
+
+func (o metricsOpt) SetDial(opts *dialOpts) {
+	opts.metrics = o.m
+}
+
+func (o metricsOpt) SetServer(opts *options) {
+	opts.metrics = o.m
+}
+
+// WithMetrics configures where measurements of the connection are reported.
+func WithMetrics(m Metrics) ConnOption {
+	return metricsOpt{m: m}
+}
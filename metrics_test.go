@@ -0,0 +1,124 @@
+package gws
+
+import (
+	"context"
+	"encoding/json"
+	"net/http/httptest"
+	"sync"
+	"testing"
+	"time"
+)
+
+type testMetrics struct {
+	mu       sync.Mutex
+	sent     map[string]int
+	received map[string]int
+	subs     int
+	queries  int
+}
+
+func newTestMetrics() *testMetrics {
+	return &testMetrics{
+		sent:     make(map[string]int),
+		received: make(map[string]int),
+	}
+}
+
+func (m *testMetrics) IncMessage(typ string, sent bool) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if sent {
+		m.sent[typ]++
+		return
+	}
+	m.received[typ]++
+}
+
+func (m *testMetrics) AddSubscriptions(delta int) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.subs += delta
+}
+
+func (m *testMetrics) ObserveQuery(time.Duration, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.queries++
+}
+
+func TestWithMetrics(t *testing.T) {
+	srvMetrics := newTestMetrics()
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+		return s.Send(context.Background(), &Response{Data: json.RawMessage(`{"hello":"world"}`)})
+	}), WithMetrics(srvMetrics)))
+	defer srv.Close()
+
+	cliMetrics := newTestMetrics()
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), WithMetrics(cliMetrics))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	cliMetrics.mu.Lock()
+	subs := cliMetrics.subs
+	cliMetrics.mu.Unlock()
+	if subs != 1 {
+		t.Logf("expected 1 active subscription, got: %d", subs)
+		t.Fail()
+		return
+	}
+
+	_, err = sub.Recv(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	_, err = sub.Recv(ctx)
+	if err != ErrUnsubscribed {
+		t.Logf("expected subscription to complete but got: %v", err)
+		t.Fail()
+		return
+	}
+
+	cliMetrics.mu.Lock()
+	defer cliMetrics.mu.Unlock()
+	if cliMetrics.subs != 0 {
+		t.Logf("expected no active subscriptions, got: %d", cliMetrics.subs)
+		t.Fail()
+	}
+	if cliMetrics.queries != 1 {
+		t.Logf("expected 1 observed query, got: %d", cliMetrics.queries)
+		t.Fail()
+	}
+	if cliMetrics.sent[string(gqlStart)] != 2 || cliMetrics.received[string(gqlData)] != 2 {
+		t.Logf("unexpected client message counts: sent: %v, received: %v", cliMetrics.sent, cliMetrics.received)
+		t.Fail()
+	}
+
+	srvMetrics.mu.Lock()
+	defer srvMetrics.mu.Unlock()
+	if srvMetrics.received[string(gqlStart)] != 2 || srvMetrics.sent[string(gqlData)] != 2 {
+		t.Logf("unexpected server message counts: sent: %v, received: %v", srvMetrics.sent, srvMetrics.received)
+		t.Fail()
+	}
+}
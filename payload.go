@@ -1,8 +1,13 @@
 package gws
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"io"
 )
 
 type reqType string
@@ -21,6 +26,12 @@ const (
 	gqlError               reqType = "error"
 	gqlComplete            reqType = "complete"
 	gqlConnectionKeepAlive reqType = "connection_keep_alive"
+
+	// "graphql-transport-ws" only
+	gqlSubscribe reqType = "subscribe"
+	gqlNext      reqType = "next"
+	gqlPing      reqType = "ping"
+	gqlPong      reqType = "pong"
 )
 
 // Request represents a payload sent from the client.
@@ -28,6 +39,78 @@ type Request struct {
 	Query         string                 `json:"query"`
 	Variables     map[string]interface{} `json:"variables"`
 	OperationName string                 `json:"operationName"`
+	Extensions    map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// PersistedQuery returns a request for query, which uses Automatic Persisted
+// Queries. See https://www.apollographql.com/docs/apollo-server/performance/apq/
+//
+// Queries and mutations are first sent with only the hash of the query. If the
+// server responds with PersistedQueryNotFound, the client automatically retries
+// with the full query, so the server can persist it.
+//
+func PersistedQuery(query string) *Request {
+	hash := sha256.Sum256([]byte(query))
+	return &Request{
+		Query: query,
+		Extensions: map[string]interface{}{
+			"persistedQuery": map[string]interface{}{
+				"version":    1,
+				"sha256Hash": hex.EncodeToString(hash[:]),
+			},
+		},
+	}
+}
+
+// isPersisted reports whether the request uses Automatic Persisted Queries.
+func (r *Request) isPersisted() bool {
+	_, ok := r.Extensions["persistedQuery"]
+	return ok
+}
+
+// ErrInvalidVariables is returned, without sending anything to the server,
+// when the variables of a request can't be encoded e.g. a value is a channel.
+// It wraps the error returned by the encoder.
+//
+type ErrInvalidVariables struct {
+	Err error
+}
+
+// Error implements the error interface.
+func (e ErrInvalidVariables) Error() string {
+	return "gws: invalid variables: " + e.Err.Error()
+}
+
+// Unwrap is for the errors package to use within its As, Is, and Unwrap functions.
+func (e ErrInvalidVariables) Unwrap() error {
+	return e.Err
+}
+
+// checkVariables reports whether the variables can be encoded with the
+// codec, so the failure is reported before anything is sent.
+//
+func checkVariables(c Codec, vars map[string]interface{}) error {
+	if len(vars) == 0 {
+		return nil
+	}
+
+	var buf bytes.Buffer
+	err := marshal(c, &buf, vars)
+	if err != nil {
+		return ErrInvalidVariables{Err: err}
+	}
+	return nil
+}
+
+// persistedQueryNotFound reports whether the server doesn't know the persisted query.
+func (r *Response) persistedQueryNotFound() bool {
+	errs, _ := r.GraphQLErrors()
+	for _, err := range errs {
+		if err.Message == "PersistedQueryNotFound" || err.Extensions["code"] == "PERSISTED_QUERY_NOT_FOUND" {
+			return true
+		}
+	}
+	return false
 }
 
 // Response represents a payload returned from the server. It supports
@@ -36,41 +119,228 @@ type Request struct {
 type Response struct {
 	Data   json.RawMessage   `json:"data"`
 	Errors []json.RawMessage `json:"errors"`
+
+	// HasNext and Incremental support the incremental delivery of results
+	// e.g. for @defer and @stream. Each incremental result is left for the
+	// user to decode and apply to the initial data.
+	//
+	HasNext     bool              `json:"hasNext,omitempty"`
+	Incremental []json.RawMessage `json:"incremental,omitempty"`
+
+	// used to decode the data and errors, if set
+	codec Codec
+}
+
+// GraphQLErrors decodes the raw response errors into GraphQLErrors.
+func (r *Response) GraphQLErrors() ([]GraphQLError, error) {
+	if len(r.Errors) == 0 {
+		return nil, nil
+	}
+
+	errs := make([]GraphQLError, len(r.Errors))
+	for i, raw := range r.Errors {
+		err := unmarshal(r.codec, raw, &errs[i])
+		if err != nil {
+			return nil, err
+		}
+	}
+	return errs, nil
+}
+
+// HasErrors reports whether the response contains any GraphQL errors.
+func (r *Response) HasErrors() bool {
+	return len(r.Errors) > 0
+}
+
+// Err returns the GraphQL errors included in the response, aggregated as
+// ResponseErrors, or nil if there are none. If the errors can't be decoded,
+// the decoding error is returned instead.
+//
+func (r *Response) Err() error {
+	errs, err := r.GraphQLErrors()
+	if err != nil {
+		return err
+	}
+	if len(errs) > 0 {
+		return ResponseErrors(errs)
+	}
+	return nil
+}
+
+// Into decodes the response data into v. If the response contains any
+// errors, they are returned as ResponseErrors, after decoding the data.
+//
+func (r *Response) Into(v interface{}) error {
+	err := r.IntoPartial(v)
+	if err != nil {
+		return err
+	}
+	return r.Err()
+}
+
+// IntoPartial decodes the response data into v, while ignoring any
+// errors included in the response. This is useful for when partial
+// data is acceptable.
+//
+func (r *Response) IntoPartial(v interface{}) error {
+	if len(r.Data) == 0 {
+		return nil
+	}
+	return unmarshal(r.codec, r.Data, v)
+}
+
+// DataReader returns a reader over the raw response data, so that it may be
+// stream decoded e.g. with json.Decoder, rather than being copied into an
+// intermediate value first. The reader doesn't copy the data, so it must not
+// be modified while reading.
+//
+func (r *Response) DataReader() io.Reader {
+	return bytes.NewReader(r.Data)
+}
+
+// ResponseErrors represents the GraphQL errors included in a Response.
+type ResponseErrors []GraphQLError
+
+// Error implements the error interface.
+func (e ResponseErrors) Error() string {
+	b := new(bytes.Buffer)
+	b.WriteString("gws: response contains errors: ")
+	for i, err := range e {
+		if i > 0 {
+			b.WriteString("; ")
+		}
+		b.WriteString(err.Message)
+	}
+	return b.String()
+}
+
+// Unwrap returns each of the errors, so the errors package may match
+// any one of them with its Is and As functions, as of Go 1.20.
+//
+func (e ResponseErrors) Unwrap() []error {
+	errs := make([]error, len(e))
+	for i, err := range e {
+		errs[i] = err
+	}
+	return errs
+}
+
+// GraphQLError represents an error as described by the GraphQL spec. See
+// https://spec.graphql.org/June2018/#sec-Errors
+//
+type GraphQLError struct {
+	Message    string                 `json:"message"`
+	Locations  []Location             `json:"locations,omitempty"`
+	Path       []interface{}          `json:"path,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
+}
+
+// Location represents a location in the GraphQL document
+// which a GraphQLError corresponds to.
+//
+type Location struct {
+	Line   int `json:"line"`
+	Column int `json:"column"`
+}
+
+// Error implements the error interface.
+func (e GraphQLError) Error() string {
+	return e.Message
 }
 
 // ServerError represents a payload which is sent by the server if
 // it encounters a non-GraphQL resolver error.
 //
 type ServerError struct {
-	Msg string `json:"msg"`
+	Msg        string                 `json:"msg"`
+	Code       string                 `json:"code,omitempty"`
+	Extensions map[string]interface{} `json:"extensions,omitempty"`
 }
 
 // Error implements the error interface.
 func (e *ServerError) Error() string {
+	if e.Code != "" {
+		return fmt.Sprintf("internal server error: %s: %s", e.Code, e.Msg)
+	}
 	return fmt.Sprintf("internal server error: %s", e.Msg)
 }
 
+// ConnectionError represents the payload of a connection_error message,
+// which the server sends when it rejects the connection e.g. due to
+// failed authentication. The payload is left for the user to decode.
+//
+type ConnectionError struct {
+	Payload json.RawMessage
+}
+
+// Error implements the error interface.
+func (e *ConnectionError) Error() string {
+	if len(e.Payload) == 0 {
+		return "gws: connection rejected by server"
+	}
+	return "gws: connection rejected by server: " + string(e.Payload)
+}
+
+// MarshalJSON implements the json.Marshaler interface, so the payload is
+// encoded as it was received.
+//
+func (e *ConnectionError) MarshalJSON() ([]byte, error) {
+	if len(e.Payload) == 0 {
+		return []byte("null"), nil
+	}
+	return e.Payload.MarshalJSON()
+}
+
 // payload represents either a Client or Server payload
 type payload interface {
 	isPayload()
 }
 
-func (*Request) isPayload()     {}
-func (*Response) isPayload()    {}
-func (*ServerError) isPayload() {}
+func (*Request) isPayload()         {}
+func (*Response) isPayload()        {}
+func (*ServerError) isPayload()     {}
+func (*ConnectionError) isPayload() {}
 
+// unknown represents the payload of an unsupported message type.
 type unknown map[string]interface{}
 
 func (unknown) isPayload() {}
 
-// opID represents a unique id per user request
-type opID string
+// rawPayload represents a payload which has already been encoded.
+type rawPayload json.RawMessage
+
+func (rawPayload) isPayload() {}
+
+// MarshalJSON implements the json.Marshaler interface.
+func (p rawPayload) MarshalJSON() ([]byte, error) {
+	return json.RawMessage(p).MarshalJSON()
+}
+
+// errorList represents the "graphql-transport-ws" error payload.
+type errorList []json.RawMessage
+
+func (errorList) isPayload() {}
+
+// OperationID identifies an operation, i.e. a query, mutation or subscription,
+// within a connection. It's the id sent in the protocol messages, so it may be
+// used to correlate client operations with server logs.
+//
+type OperationID string
 
 // operationMessage represents an Apollo "GraphQL over WebSockets Protocol" message
 type operationMessage struct {
-	ID      opID    `json:"id,omitempty"`
-	Type    reqType `json:"type"`
-	Payload payload `json:"payload,omitempty"`
+	ID      OperationID `json:"id,omitempty"`
+	Type    reqType     `json:"type"`
+	Payload payload     `json:"payload,omitempty"`
+}
+
+// RawMessage represents a protocol message, whose payload is left encoded.
+// It's used by Conn.ReadRaw and Conn.WriteRaw.
+//
+type RawMessage struct {
+	ID      OperationID     `json:"id,omitempty"`
+	Type    string          `json:"type"`
+	Payload json.RawMessage `json:"payload,omitempty"`
 }
 
 // ErrUnsupportedMsgType represents an unsupported message type, per
@@ -83,17 +353,65 @@ func (e ErrUnsupportedMsgType) Error() string {
 	return "gws: unsupported message type: " + string(e)
 }
 
+// ErrMissingType is returned when decoding a message without a type.
+var ErrMissingType = errors.New("gws: message is missing a type")
+
+// ErrMissingID represents a message type, which is specific to an
+// operation, being decoded without an operation id.
+//
+type ErrMissingID string
+
+// Error implements the error interface.
+func (e ErrMissingID) Error() string {
+	return "gws: message is missing an id: " + string(e)
+}
+
+// requiresID reports whether messages of the given type must have an id.
+func requiresID(typ reqType) bool {
+	switch typ {
+	case gqlStart, gqlSubscribe, gqlStop, gqlData, gqlNext, gqlComplete:
+		return true
+	default:
+		return false
+	}
+}
+
+// payloadBytes references the raw payload within the message being decoded.
+// Unlike json.RawMessage, it doesn't copy the payload, so it must not be
+// retained past the call to operationMessage.UnmarshalJSON.
+//
+type payloadBytes []byte
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
+func (p *payloadBytes) UnmarshalJSON(b []byte) error {
+	*p = b
+	return nil
+}
+
+// UnmarshalJSON implements the json.Unmarshaler interface.
 func (m *operationMessage) UnmarshalJSON(b []byte) error {
+	return m.unmarshal(nil, b)
+}
+
+// unmarshal decodes the message with the codec or encoding/json, if it's nil.
+func (m *operationMessage) unmarshal(c Codec, b []byte) error {
 	var raw struct {
-		ID      opID            `json:"id,omitempty"`
-		Type    reqType         `json:"type"`
-		Payload json.RawMessage `json:"payload,omitempty"`
+		ID      OperationID  `json:"id,omitempty"`
+		Type    reqType      `json:"type"`
+		Payload payloadBytes `json:"payload,omitempty"`
 	}
-	err := json.Unmarshal(b, &raw)
+	err := unmarshal(c, b, &raw)
 	if err != nil {
 		return err
 	}
 
+	if raw.Type == "" {
+		return ErrMissingType
+	}
+	if raw.ID == "" && requiresID(raw.Type) {
+		return ErrMissingID(raw.Type)
+	}
+
 	m.Type = raw.Type
 	if raw.ID != "" {
 		m.ID = raw.ID
@@ -104,19 +422,46 @@ func (m *operationMessage) UnmarshalJSON(b []byte) error {
 	}
 
 	switch m.Type {
-	case gqlConnectionInit, gqlStart, gqlStop, gqlConnectionTerminate:
+	case gqlConnectionInit, gqlConnectionAck:
+		// The connection params, and any payload the server
+		// acknowledges them with, are entirely user defined.
+		//
+		m.Payload = rawPayload(append(json.RawMessage(nil), raw.Payload...))
+		return nil
+	case gqlStart, gqlSubscribe, gqlStop, gqlConnectionTerminate:
 		req := new(Request)
 		m.Payload = req
-		return json.Unmarshal(raw.Payload, req)
-	case gqlConnectionError, gqlConnectionAck, gqlData, gqlComplete, gqlConnectionKeepAlive:
-		resp := new(Response)
+		return unmarshal(c, raw.Payload, req)
+	case gqlData, gqlNext, gqlComplete, gqlConnectionKeepAlive:
+		resp := &Response{codec: c}
 		m.Payload = resp
-		return json.Unmarshal(raw.Payload, resp)
+		return unmarshal(c, raw.Payload, resp)
+	case gqlConnectionError:
+		cerr := &ConnectionError{Payload: append(json.RawMessage(nil), raw.Payload...)}
+		m.Payload = cerr
+		return nil
 	case gqlError:
+		// "graphql-transport-ws" sends a list of GraphQL errors
+		if raw.Payload[0] == '[' {
+			resp := &Response{codec: c}
+			m.Payload = resp
+			return unmarshal(c, raw.Payload, &resp.Errors)
+		}
+
 		serr := new(ServerError)
 		m.Payload = serr
-		return json.Unmarshal(raw.Payload, serr)
+		return unmarshal(c, raw.Payload, serr)
+	case gqlPing, gqlPong:
+		u := make(unknown)
+		m.Payload = u
+		return unmarshal(c, raw.Payload, &u)
 	default:
+		// Preserve the payload, if possible, so the message can still be
+		// inspected or forwarded by the caller.
+		u := make(unknown)
+		if unmarshal(c, raw.Payload, &u) == nil {
+			m.Payload = u
+		}
 		return ErrUnsupportedMsgType(raw.Type)
 	}
 }
@@ -0,0 +1,78 @@
+//go:build go1.18
+// +build go1.18
+
+package gws
+
+import (
+	"bytes"
+	"encoding/json"
+	"testing"
+)
+
+func FuzzOperationMessage(f *testing.F) {
+	seeds := []string{
+		`{"type":"connection_init","payload":{"token":"abc"}}`,
+		`{"type":"connection_ack"}`,
+		`{"type":"ka"}`,
+		`{"id":"1","type":"start","payload":{"query":"query { search(term: \"he said \\\"hi\\\"\\n\") { id } }","operationName":"\"quoted\"\\"}}`,
+		`{"id":"1","type":"subscribe","payload":{"query":"{ hello }","variables":{"a":1},"extensions":{"persistedQuery":{"version":1,"sha256Hash":"abc"}}}}`,
+		`{"id":"1","type":"data","payload":{"data":{"hello":"world"},"errors":[{"message":"partial"}]}}`,
+		`{"id":"1","type":"next","payload":{"data":null,"hasNext":true,"incremental":[{"data":{},"path":["hero"]}]}}`,
+		`{"id":"1","type":"error","payload":{"msg":"unexpected \"token\"\n","code":"BAD"}}`,
+		`{"id":"1","type":"error","payload":[{"message":"invalid"}]}`,
+		`{"id":"1","type":"complete"}`,
+		`{"id":"1","type":"stop"}`,
+		`{"type":"connection_error","payload":{"reason":"unauthorized"}}`,
+		`{"type":"ping","payload":{"seq":1}}`,
+		badAckMsg,
+		badDataMsg,
+	}
+	for _, seed := range seeds {
+		f.Add([]byte(seed))
+	}
+
+	f.Fuzz(func(t *testing.T, b []byte) {
+		var msg operationMessage
+		if err := msg.UnmarshalJSON(b); err != nil {
+			return
+		}
+
+		// A list of errors is only valid on the "graphql-transport-ws" wire
+		_, isList := msg.Payload.(*Response)
+		isList = isList && msg.Type == gqlError
+
+		protos := []struct {
+			name   string
+			encode func(operationMessage) operationMessage
+		}{
+			{name: "graphql-ws", encode: func(m operationMessage) operationMessage { return m }},
+			{name: "graphql-transport-ws", encode: toTransportWS},
+		}
+		for _, proto := range protos {
+			if isList && proto.name == "graphql-ws" {
+				continue
+			}
+
+			first, err := json.Marshal(proto.encode(msg))
+			if err != nil {
+				t.Fatalf("%s: failed to marshal decoded message: %s: %v", proto.name, string(b), err)
+			}
+
+			var out operationMessage
+			if err = out.UnmarshalJSON(first); err != nil {
+				t.Fatalf("%s: failed to decode re-encoded message: %s: %v", proto.name, string(first), err)
+			}
+			if out.ID != msg.ID {
+				t.Fatalf("%s: expected id: %s, but got: %s", proto.name, msg.ID, out.ID)
+			}
+
+			second, err := json.Marshal(proto.encode(out))
+			if err != nil {
+				t.Fatalf("%s: failed to marshal message: %s: %v", proto.name, string(first), err)
+			}
+			if !bytes.Equal(first, second) {
+				t.Fatalf("%s: message didn't round trip: %s != %s", proto.name, string(first), string(second))
+			}
+		}
+	})
+}
@@ -4,6 +4,9 @@ import (
 	"bytes"
 	"encoding/json"
 	"errors"
+	"io"
+	"reflect"
+	"sync"
 	"testing"
 )
 
@@ -59,6 +62,32 @@ func TestOpMessage_Unmarshal(t *testing.T) {
 }`,
 			Payload: &Request{Query: "{ hello { world } }"},
 		},
+		{
+			Name: "WithExtensions",
+			JSON: `{"id":"1","type":"start","payload":{"query":"{ hello }","extensions":{"tracing":true,"client":{"name":"test"}}}}`,
+			Payload: &Request{
+				Query: "{ hello }",
+				Extensions: map[string]interface{}{
+					"tracing": true,
+					"client":  map[string]interface{}{"name": "test"},
+				},
+			},
+		},
+		{
+			Name:    "WithSubscribe",
+			JSON:    `{"id":"1","type":"subscribe","payload":{"query":"{ hello { world } }"}}`,
+			Payload: &Request{Query: "{ hello { world } }"},
+		},
+		{
+			Name:    "WithNext",
+			JSON:    `{"id":"1","type":"next","payload":{"data":{"hello":{"world":"this is a test"}}}}`,
+			Payload: &Response{Data: json.RawMessage([]byte(`{"hello":{"world":"this is a test"}}`))},
+		},
+		{
+			Name:    "WithErrorList",
+			JSON:    `{"id":"1","type":"error","payload":[{"message":"this is a test"}]}`,
+			Payload: &Response{},
+		},
 		{
 			Name: "UnsupportedType",
 			JSON: `{"type":"asdgf", "payload": {}}`,
@@ -96,6 +125,509 @@ func TestOpMessage_Unmarshal(t *testing.T) {
 	}
 }
 
+func TestOpMessage_RoundTrip(t *testing.T) {
+	testCases := []struct {
+		Name string
+		Msg  operationMessage
+	}{
+		{
+			Name: "EscapedQuery",
+			Msg: operationMessage{
+				ID:   "1",
+				Type: gqlStart,
+				Payload: &Request{
+					Query:         `query { search(term: "he said \"hi\"\n") { id } }`,
+					OperationName: `"quoted"\`,
+				},
+			},
+		},
+		{
+			Name: "WithExtensions",
+			Msg: operationMessage{
+				ID:   "1",
+				Type: gqlStart,
+				Payload: &Request{
+					Query: "{ hello { world } }",
+					Extensions: map[string]interface{}{
+						"persistedQuery": map[string]interface{}{
+							"version":    float64(1),
+							"sha256Hash": "abc",
+						},
+					},
+				},
+			},
+		},
+		{
+			Name: "IncrementalResponse",
+			Msg: operationMessage{
+				ID:   "1",
+				Type: gqlData,
+				Payload: &Response{
+					Data: json.RawMessage(`null`),
+					Incremental: []json.RawMessage{
+						json.RawMessage(`{"data":{"friends":[]},"path":["hero"]}`),
+					},
+					HasNext: true,
+				},
+			},
+		},
+		{
+			Name: "EscapedServerError",
+			Msg: operationMessage{
+				ID:      "1",
+				Type:    gqlError,
+				Payload: &ServerError{Msg: "unexpected \"token\"\n"},
+			},
+		},
+		{
+			Name: "StructuredServerError",
+			Msg: operationMessage{
+				ID:   "1",
+				Type: gqlError,
+				Payload: &ServerError{
+					Msg:  "rate limited",
+					Code: "RATE_LIMITED",
+					Extensions: map[string]interface{}{
+						"retryAfter": float64(30),
+					},
+				},
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			b, err := json.Marshal(testCase.Msg)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			msg := new(operationMessage)
+			err = msg.UnmarshalJSON(b)
+			if err != nil {
+				subT.Logf("message: %s", string(b))
+				subT.Error(err)
+				return
+			}
+
+			if msg.ID != testCase.Msg.ID || msg.Type != testCase.Msg.Type {
+				subT.Logf("expected: %v, but got: %v", testCase.Msg, msg)
+				subT.Fail()
+				return
+			}
+
+			if serr, ok := testCase.Msg.Payload.(*ServerError); ok {
+				out, ok := msg.Payload.(*ServerError)
+				if !ok || out.Msg != serr.Msg || out.Code != serr.Code || !reflect.DeepEqual(out.Extensions, serr.Extensions) {
+					subT.Logf("expected payload: %v, but got: %v", serr, msg.Payload)
+					subT.Fail()
+				}
+				return
+			}
+			comparePayloads(subT, testCase.Msg.Payload, msg.Payload)
+		})
+	}
+}
+
+func TestServerError_Error(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Err      *ServerError
+		Expected string
+	}{
+		{
+			Name:     "MessageOnly",
+			Err:      &ServerError{Msg: "boom"},
+			Expected: "internal server error: boom",
+		},
+		{
+			Name:     "WithCode",
+			Err:      &ServerError{Msg: "boom", Code: "INTERNAL"},
+			Expected: "internal server error: INTERNAL: boom",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			if s := testCase.Err.Error(); s != testCase.Expected {
+				subT.Logf("expected: %q, but got: %q", testCase.Expected, s)
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestConnectionError_MarshalJSON(t *testing.T) {
+	ex := `{"type":"connection_error","payload":{"reason":"unauthorized"}}`
+
+	var msg operationMessage
+	err := msg.UnmarshalJSON([]byte(ex))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(b) != ex {
+		t.Logf("expected: %s, but got: %s", ex, string(b))
+		t.Fail()
+		return
+	}
+}
+
+func TestRequest_OmitEmptyExtensions(t *testing.T) {
+	b, err := json.Marshal(&Request{Query: "{ hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if bytes.Contains(b, []byte("extensions")) {
+		t.Logf("expected extensions to be omitted: %s", string(b))
+		t.Fail()
+		return
+	}
+}
+
+func TestResponse_NilData(t *testing.T) {
+	msg := operationMessage{
+		ID:   "1",
+		Type: gqlData,
+		Payload: &Response{
+			Errors: []json.RawMessage{json.RawMessage(`{"message":"this is a test"}`)},
+		},
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if !json.Valid(b) {
+		t.Logf("invalid json: %s", string(b))
+		t.Fail()
+		return
+	}
+	if !bytes.Contains(b, []byte(`"data":null`)) {
+		t.Logf("expected null data: %s", string(b))
+		t.Fail()
+		return
+	}
+
+	out := new(operationMessage)
+	err = out.UnmarshalJSON(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	resp, ok := out.Payload.(*Response)
+	if !ok {
+		t.Logf("expected payload: response, but got: %#v", out.Payload)
+		t.Fail()
+		return
+	}
+	if len(resp.Errors) != 1 {
+		t.Logf("expected a single error, but got: %d", len(resp.Errors))
+		t.Fail()
+		return
+	}
+}
+
+func TestOpMessage_Malformed(t *testing.T) {
+	testCases := []struct {
+		Name string
+		JSON string
+		Err  error
+	}{
+		{
+			Name: "MissingType",
+			JSON: `{"id":"1","payload":{"query":"{ hello }"}}`,
+			Err:  ErrMissingType,
+		},
+		{
+			Name: "EmptyType",
+			JSON: `{"id":"1","type":""}`,
+			Err:  ErrMissingType,
+		},
+		{
+			Name: "StartMissingID",
+			JSON: `{"type":"start","payload":{"query":"{ hello }"}}`,
+			Err:  ErrMissingID(gqlStart),
+		},
+		{
+			Name: "SubscribeMissingID",
+			JSON: `{"type":"subscribe","payload":{"query":"{ hello }"}}`,
+			Err:  ErrMissingID(gqlSubscribe),
+		},
+		{
+			Name: "StopMissingID",
+			JSON: `{"type":"stop"}`,
+			Err:  ErrMissingID(gqlStop),
+		},
+		{
+			Name: "DataMissingID",
+			JSON: `{"type":"data","payload":{"data":{}}}`,
+			Err:  ErrMissingID(gqlData),
+		},
+		{
+			Name: "NextMissingID",
+			JSON: `{"type":"next","payload":{"data":{}}}`,
+			Err:  ErrMissingID(gqlNext),
+		},
+		{
+			Name: "CompleteMissingID",
+			JSON: `{"type":"complete"}`,
+			Err:  ErrMissingID(gqlComplete),
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			msg := new(operationMessage)
+			err := msg.UnmarshalJSON([]byte(testCase.JSON))
+			if err != testCase.Err {
+				subT.Logf("expected: %v, but got: %v", testCase.Err, err)
+				subT.Fail()
+				return
+			}
+		})
+	}
+
+	t.Run("ConnectionMessagesWithoutID", func(subT *testing.T) {
+		for _, b := range []string{`{"type":"connection_init"}`, `{"type":"connection_ack"}`, `{"type":"ka"}`} {
+			msg := new(operationMessage)
+			err := msg.UnmarshalJSON([]byte(b))
+			if err != nil {
+				subT.Logf("unexpected error for %s: %v", b, err)
+				subT.Fail()
+			}
+		}
+	})
+}
+
+func TestOpMessage_UnknownType(t *testing.T) {
+	msg := new(operationMessage)
+	err := msg.UnmarshalJSON([]byte(`{"id":"1","type":"future_thing","payload":{"hello":"world"}}`))
+
+	var typErr ErrUnsupportedMsgType
+	if !errors.As(err, &typErr) {
+		t.Logf("wrong error: %v", err)
+		t.Fail()
+		return
+	}
+
+	u, ok := msg.Payload.(unknown)
+	if !ok {
+		t.Logf("expected payload: unknown, but got: %#v", msg.Payload)
+		t.Fail()
+		return
+	}
+	if u["hello"] != "world" {
+		t.Logf("unexpected payload: %v", u)
+		t.Fail()
+		return
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(b) != `{"id":"1","type":"future_thing","payload":{"hello":"world"}}` {
+		t.Logf("payload wasn't preserved: %s", string(b))
+		t.Fail()
+		return
+	}
+}
+
+func TestResponse_GraphQLErrors(t *testing.T) {
+	resp := &Response{
+		Errors: []json.RawMessage{
+			json.RawMessage(`{"message":"first","locations":[{"line":1,"column":3}],"path":["hello",0,"world"]}`),
+			json.RawMessage(`{"message":"second","extensions":{"code":"TEST"}}`),
+		},
+	}
+
+	errs, err := resp.GraphQLErrors()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	if len(errs) != 2 {
+		t.Logf("expected 2 errors, but got: %d", len(errs))
+		t.Fail()
+		return
+	}
+
+	first := errs[0]
+	if first.Message != "first" || len(first.Locations) != 1 || first.Locations[0] != (Location{Line: 1, Column: 3}) {
+		t.Logf("unexpected error: %#v", first)
+		t.Fail()
+		return
+	}
+	if len(first.Path) != 3 || first.Path[0] != "hello" || first.Path[1] != float64(0) {
+		t.Logf("unexpected path: %v", first.Path)
+		t.Fail()
+		return
+	}
+
+	second := errs[1]
+	if second.Message != "second" || second.Extensions["code"] != "TEST" {
+		t.Logf("unexpected error: %#v", second)
+		t.Fail()
+		return
+	}
+
+	_, err = (&Response{Errors: []json.RawMessage{json.RawMessage(`"bad"`)}}).GraphQLErrors()
+	if err == nil {
+		t.Log("expected error for malformed GraphQL error")
+		t.Fail()
+		return
+	}
+}
+
+func TestResponse_Err(t *testing.T) {
+	resp := &Response{Data: json.RawMessage(`{"hello":"world"}`)}
+	if resp.HasErrors() || resp.Err() != nil {
+		t.Logf("expected no errors, but got: %v", resp.Err())
+		t.Fail()
+		return
+	}
+
+	resp.Errors = []json.RawMessage{
+		json.RawMessage(`{"message":"first"}`),
+		json.RawMessage(`{"message":"second","extensions":{"code":"TEST"}}`),
+	}
+	if !resp.HasErrors() {
+		t.Log("expected the response to have errors")
+		t.Fail()
+		return
+	}
+
+	err := resp.Err()
+	if err == nil || err.Error() != "gws: response contains errors: first; second" {
+		t.Logf("unexpected aggregated error: %v", err)
+		t.Fail()
+		return
+	}
+
+	var rerrs ResponseErrors
+	if !errors.As(err, &rerrs) {
+		t.Logf("expected ResponseErrors, but got: %T", err)
+		t.Fail()
+		return
+	}
+	errs := rerrs.Unwrap()
+	if len(errs) != 2 {
+		t.Logf("expected 2 unwrapped errors, but got: %d", len(errs))
+		t.Fail()
+		return
+	}
+	if gerr, ok := errs[1].(GraphQLError); !ok || gerr.Extensions["code"] != "TEST" {
+		t.Logf("unexpected unwrapped error: %#v", errs[1])
+		t.Fail()
+		return
+	}
+
+	resp.Errors = []json.RawMessage{json.RawMessage(`"bad"`)}
+	if err = resp.Err(); err == nil || errors.As(err, &rerrs) {
+		t.Logf("expected the decoding error, but got: %v", err)
+		t.Fail()
+		return
+	}
+}
+
+func TestResponse_DataReader(t *testing.T) {
+	resp := &Response{Data: json.RawMessage(`{"logs":["a","b","c"]}`)}
+
+	dec := json.NewDecoder(resp.DataReader())
+
+	var lines []string
+	for {
+		tok, err := dec.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if s, ok := tok.(string); ok && s != "logs" {
+			lines = append(lines, s)
+		}
+	}
+
+	if len(lines) != 3 || lines[0] != "a" || lines[2] != "c" {
+		t.Logf("unexpected lines: %v", lines)
+		t.Fail()
+		return
+	}
+}
+
+func TestResponse_Into(t *testing.T) {
+	type helloResp struct {
+		Hello struct {
+			World string `json:"world"`
+		} `json:"hello"`
+	}
+
+	resp := &Response{Data: json.RawMessage(`{"hello":{"world":"this is a test"}}`)}
+
+	var v helloResp
+	err := resp.Into(&v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if v.Hello.World != "this is a test" {
+		t.Logf("expected: %s, but got: %s", "this is a test", v.Hello.World)
+		t.Fail()
+		return
+	}
+
+	resp.Errors = []json.RawMessage{json.RawMessage(`{"message":"partial failure"}`)}
+
+	v = helloResp{}
+	err = resp.Into(&v)
+	var respErrs ResponseErrors
+	if !errors.As(err, &respErrs) {
+		t.Logf("wrong error: %v", err)
+		t.Fail()
+		return
+	}
+	if len(respErrs) != 1 || respErrs[0].Message != "partial failure" {
+		t.Logf("unexpected errors: %v", respErrs)
+		t.Fail()
+		return
+	}
+	if v.Hello.World != "this is a test" {
+		t.Log("expected data to still be decoded")
+		t.Fail()
+		return
+	}
+
+	v = helloResp{}
+	err = resp.IntoPartial(&v)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if v.Hello.World != "this is a test" {
+		t.Logf("expected: %s, but got: %s", "this is a test", v.Hello.World)
+		t.Fail()
+		return
+	}
+}
+
 const benchReq = `{
   "id": "1",
   "type": "start",
@@ -106,6 +638,7 @@ const benchReq = `{
 
 func BenchmarkOpMessage_Unmarshal(b *testing.B) {
 	b.Run("Via UnmarshalJSON", func(subB *testing.B) {
+		subB.ReportAllocs()
 		for i := 0; i < subB.N; i++ {
 			msg := new(operationMessage)
 			err := msg.UnmarshalJSON([]byte(benchReq))
@@ -116,6 +649,7 @@ func BenchmarkOpMessage_Unmarshal(b *testing.B) {
 	})
 
 	b.Run("Via json.Unmarshal", func(subB *testing.B) {
+		subB.ReportAllocs()
 		for i := 0; i < subB.N; i++ {
 			msg := new(operationMessage)
 			err := json.Unmarshal([]byte(benchReq), msg)
@@ -126,6 +660,44 @@ func BenchmarkOpMessage_Unmarshal(b *testing.B) {
 	})
 }
 
+func BenchmarkOpMessage_Marshal(b *testing.B) {
+	msg := operationMessage{
+		ID:      "1",
+		Type:    gqlData,
+		Payload: &Response{Data: []byte(`{"hello":{"world":"this is a test"}}`)},
+	}
+
+	b.Run("Via json.Marshal", func(subB *testing.B) {
+		subB.ReportAllocs()
+		for i := 0; i < subB.N; i++ {
+			_, err := json.Marshal(&msg)
+			if err != nil {
+				subB.Error(err)
+			}
+		}
+	})
+
+	// Mirrors how Conn.write encodes messages
+	b.Run("Via pooled buffer", func(subB *testing.B) {
+		pool := &sync.Pool{
+			New: func() interface{} {
+				return new(bytes.Buffer)
+			},
+		}
+
+		subB.ReportAllocs()
+		for i := 0; i < subB.N; i++ {
+			buf := pool.Get().(*bytes.Buffer)
+			err := json.NewEncoder(buf).Encode(&msg)
+			if err != nil {
+				subB.Error(err)
+			}
+			buf.Reset()
+			pool.Put(buf)
+		}
+	})
+}
+
 func comparePayloads(t *testing.T, ex, out payload) {
 	t.Helper()
 
@@ -138,7 +710,7 @@ func comparePayloads(t *testing.T, ex, out payload) {
 			return
 		}
 
-		if v.Query != u.Query || v.OperationName != u.OperationName {
+		if v.Query != u.Query || v.OperationName != u.OperationName || !reflect.DeepEqual(v.Extensions, u.Extensions) {
 			t.Logf("requests aren't equal: %v::%v", u, v)
 			t.Fail()
 			return
@@ -156,6 +728,12 @@ func comparePayloads(t *testing.T, ex, out payload) {
 			t.Fail()
 			return
 		}
+
+		if u.HasNext != v.HasNext || !reflect.DeepEqual(u.Incremental, v.Incremental) {
+			t.Logf("expected incremental results: %s, but got: %s", u.Incremental, v.Incremental)
+			t.Fail()
+			return
+		}
 	case unknown:
 		t.Log("expected payload is: unknown which should never happen")
 		t.Fail()
@@ -0,0 +1,64 @@
+package gws
+
+import (
+	"bufio"
+	"context"
+	"net"
+	"net/http"
+	"net/http/httptest"
+
+	"nhooyr.io/websocket"
+)
+
+// Pipe creates a synchronous, in-memory, full duplex connection, analogous
+// to net.Pipe, without needing a network listener. The client end may be
+// used with NewClient, while the server end is served by a handler's
+// ServeConn.
+//
+func Pipe() (client, server *Conn) {
+	var swc *websocket.Conn
+	rt := pipeTransport(func(w http.ResponseWriter, req *http.Request) {
+		swc, _ = websocket.Accept(w, req, &websocket.AcceptOptions{
+			Subprotocols: subprotocols,
+		})
+	})
+
+	cwc, _, err := websocket.Dial(context.Background(), "ws://pipe", &websocket.DialOptions{
+		HTTPClient:   &http.Client{Transport: rt},
+		Subprotocols: subprotocols,
+	})
+	if err != nil {
+		// Only possible if the in-memory handshake is broken
+		panic(err)
+	}
+
+	return newConn(cwc, MessageText), newConn(swc, MessageText)
+}
+
+// pipeTransport performs the WebSocket handshake over a net.Pipe.
+type pipeTransport http.HandlerFunc
+
+func (t pipeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	cc, sc := net.Pipe()
+
+	w := pipeHijacker{
+		ResponseRecorder: httptest.NewRecorder(),
+		conn:             sc,
+	}
+	t(w, req)
+
+	resp := w.Result()
+	if resp.StatusCode == http.StatusSwitchingProtocols {
+		resp.Body = cc
+	}
+	return resp, nil
+}
+
+type pipeHijacker struct {
+	*httptest.ResponseRecorder
+	conn net.Conn
+}
+
+func (w pipeHijacker) Hijack() (net.Conn, *bufio.ReadWriter, error) {
+	return w.conn, bufio.NewReadWriter(bufio.NewReader(w.conn), bufio.NewWriter(w.conn)), nil
+}
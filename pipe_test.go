@@ -0,0 +1,59 @@
+package gws
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestPipe(t *testing.T) {
+	cc, sc := Pipe()
+
+	h := NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		if req.Query != "{ hello }" {
+			return errors.New("unknown query")
+		}
+		defer s.Close()
+		return s.Send(context.Background(), &Response{Data: json.RawMessage(`{"hello":"world"}`)})
+	}))
+
+	served := make(chan struct{})
+	go func() {
+		defer close(served)
+		h.ServeConn(context.Background(), sc)
+	}()
+
+	client := NewClient(cc)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	resp, err := client.Query(ctx, &Request{Query: "{ hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if string(resp.Data) != `{"hello":"world"}` {
+		t.Log("unexpected response:", string(resp.Data))
+		t.Fail()
+		return
+	}
+
+	_, err = client.Query(ctx, &Request{Query: "{ goodbye }"})
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Log("expected server error but got:", err)
+		t.Fail()
+		return
+	}
+
+	client.Close()
+	select {
+	case <-served:
+	case <-ctx.Done():
+		t.Log("expected ServeConn to return once the client closed")
+		t.Fail()
+	}
+}
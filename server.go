@@ -2,8 +2,10 @@ package gws
 
 import (
 	"context"
+	"encoding/json"
 	"errors"
 	"net/http"
+	"sync"
 	"time"
 
 	"nhooyr.io/websocket"
@@ -14,6 +16,28 @@ import (
 //
 var ErrStreamClosed = errors.New("gws: stream is closed")
 
+// ErrTerminate terminates the whole connection, instead of just the
+// operation, when returned by a Handler or ConnectionInitFunc e.g. to
+// enforce rate limits or revoke a client's authorization mid-session.
+// It may also be wrapped.
+//
+// For "graphql-ws", a connection_error message with the reason is sent
+// before the connection is closed with the code. "graphql-transport-ws" has
+// no connection_error message, so the connection is only closed.
+//
+type ErrTerminate struct {
+	// Code is the WebSocket close status code. It defaults to CloseForbidden.
+	Code CloseCode
+
+	// Reason is the reason for terminating the connection.
+	Reason string
+}
+
+// Error implements the error interface.
+func (e ErrTerminate) Error() string {
+	return "gws: connection terminated: " + e.Reason
+}
+
 // Handler is for handling incoming GraphQL queries. All other
 // "GraphQL over Websocket" protocol messages are automatically
 // handled internally.
@@ -21,6 +45,12 @@ var ErrStreamClosed = errors.New("gws: stream is closed")
 // All resolvers errors should be included in *Response and
 // any validation error should be returned as error.
 //
+// A *Response with Errors set is sent with Stream.Send, as a data message,
+// since partial results may accompany the errors and the operation may
+// continue. Whereas, a returned error is sent as an error message e.g. a
+// *ServerError for "graphql-ws", and ends the operation. Returning an
+// ErrTerminate ends the whole connection instead.
+//
 type Handler interface {
 	ServeGraphQL(*Stream, *Request) error
 }
@@ -33,16 +63,148 @@ func (f HandlerFunc) ServeGraphQL(s *Stream, req *Request) error {
 	return f(s, req)
 }
 
+// SubscriptionHandlerFunc is an adapter to allow the use of ordinary functions,
+// which produce a channel of results, as Request handlers. Each value received
+// from the channel is sent to the client and the stream is completed once
+// the channel is closed.
+//
+// The context is cancelled once the client stops the operation or the
+// connection is closed, after which the function should stop producing
+// results and close the channel.
+//
+type SubscriptionHandlerFunc func(context.Context, *Request) (<-chan *Response, error)
+
+// ServeGraphQL implements the Handler interface.
+func (f SubscriptionHandlerFunc) ServeGraphQL(s *Stream, req *Request) error {
+	ctx := s.Context()
+
+	results, err := f(ctx, req)
+	if err != nil {
+		return err
+	}
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case resp, ok := <-results:
+			if !ok {
+				s.Close()
+				return nil
+			}
+
+			// The stream context isn't used for writing since cancelling
+			// an in-flight write would close the whole connection.
+			err = s.Send(context.TODO(), resp)
+			if err == ErrStreamClosed || ctx.Err() != nil {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+		}
+	}
+}
+
+// NewSubscriptionHandler is a convenience for calling
+// NewHandler with a SubscriptionHandlerFunc.
+//
+func NewSubscriptionHandler(f func(context.Context, *Request) (<-chan *Response, error), opts ...ServerOption) GracefulHandler {
+	return NewHandler(SubscriptionHandlerFunc(f), opts...)
+}
+
+// ResponseSink receives the results of an operation, as they're produced,
+// and lets the handler control when the operation is completed e.g. for
+// subscriptions or incrementally delivered results.
+//
+type ResponseSink interface {
+	// Send sends a result to the client.
+	Send(*Response) error
+
+	// Complete tells the client no more results will be sent.
+	Complete() error
+}
+
+// SinkHandlerFunc is an adapter to allow the use of ordinary functions, which
+// send results to a ResponseSink, as Request handlers. The operation is
+// completed once the function returns, unless it has already been completed
+// or an error is returned.
+//
+// The context is cancelled once the client stops the operation or the
+// connection is closed.
+//
+type SinkHandlerFunc func(context.Context, *Request, ResponseSink) error
+
+// ServeGraphQL implements the Handler interface.
+func (f SinkHandlerFunc) ServeGraphQL(s *Stream, req *Request) error {
+	err := f(s.Context(), req, streamSink{s})
+	if err != nil {
+		return err
+	}
+
+	s.Close()
+	return nil
+}
+
+// streamSink adapts a Stream to the ResponseSink interface.
+type streamSink struct {
+	s *Stream
+}
+
+// Send implements the ResponseSink interface.
+func (w streamSink) Send(resp *Response) error {
+	// As with SubscriptionHandlerFunc, writes aren't bound to the stream context.
+	return w.s.Send(context.TODO(), resp)
+}
+
+// Complete implements the ResponseSink interface.
+func (w streamSink) Complete() error {
+	return w.s.Close()
+}
+
+type headersKey struct{}
+
+// HeadersFromContext returns the headers of the HTTP request which
+// initiated the WebSocket connection. The context must be derived
+// from the one provided by Stream.Context.
+//
+func HeadersFromContext(ctx context.Context) http.Header {
+	h, _ := ctx.Value(headersKey{}).(http.Header)
+	return h
+}
+
 // Stream is used for streaming responses back to the client.
 type Stream struct {
 	conn *Conn
-	id   opID
+	sess *session
+	id   OperationID
+
+	ctx    context.Context
+	cancel context.CancelFunc
 
+	// guards against sending data after the stream has been completed
+	mu   sync.Mutex
 	done chan struct{}
 }
 
+// ID returns the id, which the client assigned, of the stream's operation.
+func (s *Stream) ID() OperationID {
+	return s.id
+}
+
+// Context returns the context of the stream, which is cancelled
+// once the stream is closed, the client stops the operation
+// or the connection is closed.
+//
+func (s *Stream) Context() context.Context {
+	return s.ctx
+}
+
 // Send sends a response to the client. It is safe for concurrent use.
 func (s *Stream) Send(ctx context.Context, resp *Response) error {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	select {
 	case <-s.done:
 		return ErrStreamClosed
@@ -59,23 +221,50 @@ func (s *Stream) Send(ctx context.Context, resp *Response) error {
 // prevent any leaks.
 //
 func (s *Stream) Close() error {
+	if !s.end() {
+		return ErrStreamClosed
+	}
+	return s.conn.write(context.TODO(), operationMessage{ID: s.id, Type: gqlComplete})
+}
+
+// end cancels the stream and stops any further Sends, without notifying
+// the client. It reports whether or not the stream was still open.
+//
+func (s *Stream) end() bool {
+	// Signal the handler before waiting on any in-flight Send
+	s.cancel()
+
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
 	select {
 	case <-s.done:
-		return ErrStreamClosed
+		return false
 	default:
 	}
 	close(s.done)
-
-	return s.conn.write(context.TODO(), operationMessage{ID: s.id, Type: gqlComplete})
+	s.sess.forget(s)
+	return true
 }
 
 type options struct {
 	origins   []string
+	protos    []string
 	mode      CompressionMode
 	threshold int
 	typ       MessageType
 	keepAlive bool
 	period    time.Duration
+	initFunc  ConnectionInitFunc
+
+	initTimeout  time.Duration
+	writeTimeout time.Duration
+	readLimit    int64
+	maxOps       int
+	skipVerify   bool
+	metrics      Metrics
+	logger       Logger
+	codec        Codec
 }
 
 // ServerOption allows the user to configure the handler.
@@ -97,8 +286,34 @@ func WithOrigins(origins ...string) ServerOption {
 	})
 }
 
-// WithKeepAlive configures the server to send a GQL_CONNECTION_ACK
-// message periodically to keep the client connection alive.
+// WithInsecureSkipVerify disables verifying the origin of incoming
+// connections, so any cross origin WebSocket is accepted. Prefer
+// WithOrigins, unless the handler authenticates requests itself
+// e.g. with a token, rather than relying on cookies.
+//
+func WithInsecureSkipVerify(skip bool) ServerOption {
+	return soptFn(func(opts *options) {
+		opts.skipVerify = skip
+	})
+}
+
+// WithServerSubprotocols restricts the subprotocols accepted by the handler,
+// in order of preference. By default, all subprotocols implemented by this
+// package are accepted, with SubprotocolGraphQLWS preferred. Unsupported
+// subprotocols are ignored.
+//
+// Either way, each connection is served using the message vocabulary of
+// the subprotocol negotiated with the client.
+//
+func WithServerSubprotocols(protos ...string) ServerOption {
+	return soptFn(func(opts *options) {
+		opts.protos = protos
+	})
+}
+
+// WithKeepAlive configures the server to send a GQL_CONNECTION_KEEP_ALIVE
+// message periodically to keep the client connection alive. This helps
+// clients behind proxies with idle timeouts from being disconnected.
 //
 func WithKeepAlive(period time.Duration) ServerOption {
 	return soptFn(func(opts *options) {
@@ -107,6 +322,42 @@ func WithKeepAlive(period time.Duration) ServerOption {
 	})
 }
 
+// ConnectionInitFunc is called with the payload of the connection_init
+// message, which is commonly used for authentication. The returned context
+// is used as the parent context for all subsequent operations on the
+// connection. If an error is returned, the connection is rejected.
+//
+type ConnectionInitFunc func(context.Context, json.RawMessage) (context.Context, error)
+
+// WithConnectionInitFunc configures the server to call f upon
+// receiving a connection_init message, before acknowledging it.
+//
+func WithConnectionInitFunc(f ConnectionInitFunc) ServerOption {
+	return soptFn(func(opts *options) {
+		opts.initFunc = f
+	})
+}
+
+// WithConnectionInitTimeout configures the server to close connections, with
+// CloseInitTimeout, which don't send a connection_init message within timeout
+// of being accepted, as required by the "graphql-transport-ws" subprotocol.
+//
+func WithConnectionInitTimeout(timeout time.Duration) ServerOption {
+	return soptFn(func(opts *options) {
+		opts.initTimeout = timeout
+	})
+}
+
+// WithMaxConcurrentOps limits the number of operations which may be active,
+// at once, on a single connection. Any operation started beyond the limit is
+// rejected with an error message, until an active operation completes.
+//
+func WithMaxConcurrentOps(n int) ServerOption {
+	return soptFn(func(opts *options) {
+		opts.maxOps = n
+	})
+}
+
 type handler struct {
 	Handler
 
@@ -114,28 +365,104 @@ type handler struct {
 	mtyp      MessageType
 	keepAlive bool
 	period    time.Duration
+	initFunc  ConnectionInitFunc
+
+	initTimeout  time.Duration
+	writeTimeout time.Duration
+	readLimit    int64
+	maxOps       int
+	metrics      Metrics
+	logger       Logger
+	codec        Codec
+
+	// tracks active connections for Shutdown
+	mu           sync.Mutex
+	sessions     map[*session]struct{}
+	wg           sync.WaitGroup
+	shuttingDown bool
+}
+
+// GracefulHandler is an http.Handler which can be gracefully shutdown.
+type GracefulHandler interface {
+	http.Handler
+
+	// Shutdown gracefully shuts down all connections, similar to
+	// http.Server.Shutdown. New connections and operations are rejected,
+	// while in-flight operations are left to finish. Once they have, any
+	// remaining streams are completed and the connection is closed.
+	//
+	// If the context is cancelled before all connections are closed,
+	// they are closed immediately and the context error is returned.
+	//
+	Shutdown(context.Context) error
+
+	// ServeConn serves an already established connection e.g. the server
+	// end of a Pipe. It blocks until the connection is closed.
+	//
+	ServeConn(context.Context, *Conn)
+
+	// Connections returns the number of connections being served.
+	Connections() int
+
+	// Stats returns a snapshot of the connections and operations being served.
+	Stats() ServerStats
+}
+
+// ServerStats is a snapshot of what a GracefulHandler is serving.
+type ServerStats struct {
+	// Connections is the number of connections being served.
+	Connections int
+
+	// Operations is the number of in-flight operations, across all connections.
+	Operations int
+
+	// ShuttingDown reports whether Shutdown has been called.
+	ShuttingDown bool
 }
 
 // NewHandler configures an http.Handler, which will upgrade
-// incoming connections to WebSocket and serve the "graphql-ws" subprotocol.
+// incoming connections to WebSocket and serve the "graphql-ws" or
+// "graphql-transport-ws" subprotocol, as negotiated with the client.
 //
-func NewHandler(h Handler, opts ...ServerOption) http.Handler {
+func NewHandler(h Handler, opts ...ServerOption) GracefulHandler {
 	sopts := &options{
-		typ: MessageBinary,
+		typ:  MessageText,
+		mode: CompressionDisabled,
 	}
 
 	for _, opt := range opts {
 		opt.SetServer(sopts)
 	}
 
+	protos := subprotocols
+	if sopts.protos != nil {
+		protos = nil
+		for _, p := range sopts.protos {
+			if isSupported(p) {
+				protos = append(protos, p)
+			}
+		}
+	}
+
 	return &handler{
 		Handler:   h,
 		keepAlive: sopts.keepAlive,
 		period:    sopts.period,
+		initFunc:  sopts.initFunc,
 		mtyp:      sopts.typ,
+
+		initTimeout:  sopts.initTimeout,
+		writeTimeout: sopts.writeTimeout,
+		readLimit:    sopts.readLimit,
+		maxOps:       sopts.maxOps,
+		metrics:      sopts.metrics,
+		logger:       sopts.logger,
+		codec:        sopts.codec,
+		sessions:     make(map[*session]struct{}),
 		wcOptions: &websocket.AcceptOptions{
-			Subprotocols:         []string{"graphql-ws"},
+			Subprotocols:         protos,
 			OriginPatterns:       sopts.origins,
+			InsecureSkipVerify:   sopts.skipVerify,
 			CompressionMode:      websocket.CompressionMode(sopts.mode),
 			CompressionThreshold: sopts.threshold,
 		},
@@ -143,25 +470,83 @@ func NewHandler(h Handler, opts ...ServerOption) http.Handler {
 }
 
 func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if !h.begin() {
+		http.Error(w, "server is shutting down", http.StatusServiceUnavailable)
+		return
+	}
+	defer h.wg.Done()
+
 	wc, err := websocket.Accept(w, req, h.wcOptions)
 	if err != nil {
 		// TODO: Handle error
 		return
 	}
-	conn := newConn(wc, h.mtyp)
 
-	ctx, cancel := context.WithCancel(req.Context())
+	ctx := context.WithValue(req.Context(), headersKey{}, req.Header)
+	h.serve(ctx, newConn(wc, h.mtyp))
+}
+
+func (h *handler) ServeConn(ctx context.Context, conn *Conn) {
+	if !h.begin() {
+		conn.wc.Close(websocket.StatusGoingAway, "server is shutting down")
+		return
+	}
+	defer h.wg.Done()
+
+	conn.mtyp = websocket.MessageType(h.mtyp)
+	h.serve(ctx, conn)
+}
+
+// begin reports whether a new connection may be served and,
+// if so, tracks it until wg.Done is called.
+//
+func (h *handler) begin() bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shuttingDown {
+		return false
+	}
+	h.wg.Add(1)
+	return true
+}
+
+// serve handles messages from conn until it is closed.
+func (h *handler) serve(ctx context.Context, conn *Conn) {
+	conn.writeTimeout = h.writeTimeout
+	conn.setReadLimit(h.readLimit)
+	conn.setMetrics(h.metrics)
+	conn.setLogger(h.logger)
+	conn.codec = h.codec
+
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
-	defer wc.CloseRead(ctx)
+	defer conn.wc.Close(websocket.StatusNormalClosure, "closed")
 
-	streams := make(map[opID]*Stream)
-	defer func() {
-		for _, s := range streams {
-			s.Close()
-		}
-	}()
+	sess := &session{
+		conn:    conn,
+		maxOps:  h.maxOps,
+		streams: make(map[OperationID]*Stream),
+	}
+	defer sess.closeStreams()
+
+	if !h.track(sess) {
+		sess.drain(ctx)
+		return
+	}
+	defer h.untrack(sess)
+
+	var initTimer *time.Timer
+	if h.initTimeout > 0 {
+		initTimer = time.AfterFunc(h.initTimeout, func() {
+			conn.wc.Close(websocket.StatusCode(CloseInitTimeout), "Connection initialisation timeout")
+		})
+		defer initTimer.Stop()
+	}
 
 	// Handle messages
+	var initialized bool
+	opCtx := ctx
 	msg := new(operationMessage)
 	for {
 		b, err := conn.read(ctx)
@@ -170,7 +555,11 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			return
 		}
 
-		err = msg.UnmarshalJSON(b)
+		msg.ID = ""
+		msg.Payload = nil
+		msg.Type = ""
+
+		err = msg.unmarshal(conn.codec, b)
 		if err != nil {
 			conn.write(ctx, operationMessage{
 				Type:    gqlError,
@@ -178,48 +567,88 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 			})
 			continue
 		}
+		conn.received(msg)
 
 		switch msg.Type {
 		case gqlConnectionInit:
+			if initialized && conn.proto == SubprotocolGraphQLTransportWS {
+				conn.wc.Close(websocket.StatusCode(CloseTooManyInitRequests), "Too many initialisation requests")
+				return
+			}
+			if initTimer != nil {
+				initTimer.Stop()
+			}
+			if h.initFunc != nil {
+				params, _ := msg.Payload.(rawPayload)
+				ictx, err := h.initFunc(ctx, json.RawMessage(params))
+				var terr ErrTerminate
+				if errors.As(err, &terr) {
+					terminateConn(ctx, conn, terr)
+					return
+				}
+				if err != nil {
+					rejectConn(ctx, conn, err)
+					return
+				}
+				opCtx = ictx
+			}
+
 			// TODO(zaba505): handle these errors errors
 			conn.write(ctx, operationMessage{Type: gqlConnectionAck})
-			if !h.keepAlive {
+			if !h.keepAlive || initialized {
+				initialized = true
 				break
 			}
+			initialized = true
 
 			conn.write(ctx, operationMessage{Type: gqlConnectionKeepAlive})
-			go func() {
-				for {
-					timer := time.NewTimer(h.period)
-					select {
-					case <-timer.C:
-						conn.write(ctx, operationMessage{Type: gqlConnectionKeepAlive})
-					case <-ctx.Done():
-						timer.Stop()
-						return
-					}
-				}
-			}()
+			go keepAlive(ctx, conn, h.period)
 			break
-		case gqlStart:
-			s := &Stream{
-				id:   msg.ID,
-				conn: conn,
-				done: make(chan struct{}, 1),
+		case gqlStart, gqlSubscribe:
+			req, ok := msg.Payload.(*Request)
+			if !ok {
+				conn.write(ctx, operationMessage{
+					ID:      msg.ID,
+					Type:    gqlError,
+					Payload: &ServerError{Msg: "missing request payload"},
+				})
+				break
 			}
 
-			streams[msg.ID] = s
+			if sess.has(msg.ID) {
+				conn.wc.Close(websocket.StatusCode(CloseSubscriberExists), "Subscriber for "+string(msg.ID)+" already exists")
+				return
+			}
 
-			go handleRequest(s, h, msg.ID, msg.Payload.(*Request))
-			break
-		case gqlStop:
-			s, ok := streams[msg.ID]
-			if !ok {
+			sctx, scancel := context.WithCancel(opCtx)
+			s := &Stream{
+				id:     msg.ID,
+				conn:   conn,
+				sess:   sess,
+				ctx:    sctx,
+				cancel: scancel,
+				done:   make(chan struct{}, 1),
+			}
+
+			if err := sess.start(s); err != nil {
+				scancel()
+				conn.write(ctx, operationMessage{
+					ID:      msg.ID,
+					Type:    gqlError,
+					Payload: &ServerError{Msg: err.Error()},
+				})
 				break
 			}
-			delete(streams, msg.ID)
 
-			s.Close()
+			go func() {
+				defer sess.active.Done()
+				handleRequest(s, h, s.id, req)
+			}()
+			break
+		case gqlStop, gqlComplete:
+			sess.stop(msg.ID)
+		case gqlPing:
+			conn.write(ctx, operationMessage{Type: gqlPong, Payload: msg.Payload})
 		case gqlConnectionTerminate:
 			return
 		default:
@@ -229,9 +658,237 @@ func (h *handler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	}
 }
 
-func handleRequest(s *Stream, h Handler, id opID, req *Request) {
+// Shutdown implements the GracefulHandler interface.
+func (h *handler) Shutdown(ctx context.Context) error {
+	h.mu.Lock()
+	h.shuttingDown = true
+	for sess := range h.sessions {
+		go sess.drain(ctx)
+	}
+	h.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		h.wg.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-done:
+		return nil
+	}
+}
+
+// Connections implements the GracefulHandler interface.
+func (h *handler) Connections() int {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	return len(h.sessions)
+}
+
+// Stats implements the GracefulHandler interface.
+func (h *handler) Stats() ServerStats {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	stats := ServerStats{
+		Connections:  len(h.sessions),
+		ShuttingDown: h.shuttingDown,
+	}
+	for sess := range h.sessions {
+		sess.mu.Lock()
+		stats.Operations += len(sess.streams)
+		sess.mu.Unlock()
+	}
+	return stats
+}
+
+// track registers a session to be drained by Shutdown.
+// It returns false if Shutdown has already been called.
+//
+func (h *handler) track(sess *session) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.shuttingDown {
+		return false
+	}
+	h.sessions[sess] = struct{}{}
+	return true
+}
+
+func (h *handler) untrack(sess *session) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	delete(h.sessions, sess)
+}
+
+// session tracks the streams of a single connection.
+type session struct {
+	conn   *Conn
+	maxOps int
+
+	mu       sync.Mutex
+	streams  map[OperationID]*Stream
+	draining bool
+
+	// in-flight handlers
+	active sync.WaitGroup
+}
+
+var (
+	errShuttingDown = errors.New("server is shutting down")
+	errTooManyOps   = errors.New("too many concurrent operations")
+)
+
+// start tracks a new stream, unless the session is being drained
+// or it already has the maximum number of active streams.
+//
+func (sess *session) start(s *Stream) error {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.draining {
+		return errShuttingDown
+	}
+	if sess.maxOps > 0 && len(sess.streams) >= sess.maxOps {
+		return errTooManyOps
+	}
+	sess.streams[s.id] = s
+	sess.active.Add(1)
+	return nil
+}
+
+// has reports whether there is an active stream for the given operation.
+func (sess *session) has(id OperationID) bool {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	_, ok := sess.streams[id]
+	return ok
+}
+
+// forget stops tracking the stream, once it has ended.
+func (sess *session) forget(s *Stream) {
+	sess.mu.Lock()
+	defer sess.mu.Unlock()
+
+	if sess.streams[s.id] == s {
+		delete(sess.streams, s.id)
+	}
+}
+
+// stop closes the stream for the given operation, if any.
+func (sess *session) stop(id OperationID) {
+	sess.mu.Lock()
+	s, ok := sess.streams[id]
+	delete(sess.streams, id)
+	sess.mu.Unlock()
+	if !ok {
+		return
+	}
+
+	s.Close()
+}
+
+func (sess *session) closeStreams() {
+	sess.mu.Lock()
+	streams := sess.streams
+	sess.streams = make(map[OperationID]*Stream)
+	sess.mu.Unlock()
+
+	for _, s := range streams {
+		s.Close()
+	}
+}
+
+// drain waits for all in-flight handlers to return, or the context to be
+// cancelled, and then completes any remaining streams and closes the connection.
+//
+func (sess *session) drain(ctx context.Context) {
+	sess.mu.Lock()
+	sess.draining = true
+	sess.mu.Unlock()
+
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		sess.active.Wait()
+	}()
+
+	select {
+	case <-ctx.Done():
+	case <-done:
+	}
+
+	sess.closeStreams()
+	sess.conn.wc.Close(websocket.StatusGoingAway, "server is shutting down")
+}
+
+// rejectConn notifies the client that its connection_init was rejected.
+func rejectConn(ctx context.Context, conn *Conn, err error) {
+	conn.logger.Debug("rejecting connection", "err", err)
+	if conn.proto == SubprotocolGraphQLTransportWS {
+		// "graphql-transport-ws" has no connection_error message
+		conn.wc.Close(websocket.StatusCode(CloseForbidden), "Forbidden")
+		return
+	}
+
+	b, _ := json.Marshal(map[string]string{"message": err.Error()})
+	conn.write(ctx, operationMessage{Type: gqlConnectionError, Payload: rawPayload(b)})
+}
+
+// terminateConn notifies the client that its connection is being
+// terminated, if the subprotocol allows, and then closes it.
+//
+func terminateConn(ctx context.Context, conn *Conn, terr ErrTerminate) {
+	if terr.Code == 0 {
+		terr.Code = CloseForbidden
+	}
+	conn.logger.Debug("terminating connection", "code", terr.Code, "reason", terr.Reason)
+
+	if conn.proto != SubprotocolGraphQLTransportWS {
+		b, _ := json.Marshal(map[string]string{"message": terr.Reason})
+		conn.write(ctx, operationMessage{Type: gqlConnectionError, Payload: rawPayload(b)})
+	}
+	conn.wc.Close(websocket.StatusCode(terr.Code), terr.Reason)
+}
+
+// keepAlive periodically sends a keep alive message until
+// either the context is cancelled or the connection is closed.
+//
+func keepAlive(ctx context.Context, conn *Conn, period time.Duration) {
+	ticker := time.NewTicker(period)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			conn.write(ctx, operationMessage{Type: gqlConnectionKeepAlive})
+		case <-conn.done:
+			return
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+func handleRequest(s *Stream, h Handler, id OperationID, req *Request) {
 	err := h.ServeGraphQL(s, req)
+
+	var terr ErrTerminate
+	if errors.As(err, &terr) {
+		s.end()
+		terminateConn(context.TODO(), s.conn, terr)
+		return
+	}
 	if err != nil {
+		// Nothing may be sent after the error
+		s.end()
 		s.conn.write(context.TODO(), operationMessage{
 			ID:      id,
 			Type:    gqlError,
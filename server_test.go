@@ -1,14 +1,18 @@
 package gws
 
 import (
+	"bytes"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
+	"fmt"
 	"net"
 	"net/http"
 	"net/http/httptest"
 	_ "net/http/pprof"
 	"strconv"
+	"strings"
 	"sync"
 	"testing"
 	"time"
@@ -35,6 +39,223 @@ func TestServerOptions(t *testing.T) {
 	conn.Close()
 }
 
+func TestWithCompression_Server(t *testing.T) {
+	testCases := []struct {
+		Name       string
+		Server     []ServerOption
+		Client     CompressionMode
+		Compressed bool
+	}{
+		{
+			Name:       "NoContextTakeover",
+			Server:     []ServerOption{WithCompression(CompressionNoContextTakeover, 1)},
+			Client:     CompressionNoContextTakeover,
+			Compressed: true,
+		},
+		{
+			Name:       "ContextTakeover",
+			Server:     []ServerOption{WithCompression(CompressionContextTakeover, 1)},
+			Client:     CompressionContextTakeover,
+			Compressed: true,
+		},
+		{
+			Name:       "Mixed",
+			Server:     []ServerOption{WithCompression(CompressionContextTakeover, 1)},
+			Client:     CompressionNoContextTakeover,
+			Compressed: true,
+		},
+		{
+			Name:   "Disabled",
+			Server: []ServerOption{WithCompression(CompressionDisabled, 1)},
+			Client: CompressionNoContextTakeover,
+		},
+		{
+			Name:   "Default",
+			Client: CompressionNoContextTakeover,
+		},
+	}
+
+	// Echo the query back, so both directions carry a compressible message,
+	// which is small enough to be written as a single frame.
+	//
+	query := "{ " + strings.Repeat("hello ", 256) + "}"
+	h := HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+		return s.Send(context.TODO(), &Response{Data: []byte(strconv.Quote(req.Query))})
+	})
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := httptest.NewServer(NewHandler(h, testCase.Server...))
+			defer srv.Close()
+
+			var rec *frameRecorder
+			client := &http.Client{
+				Transport: &http.Transport{
+					DialContext: func(ctx context.Context, network, addr string) (net.Conn, error) {
+						conn, err := new(net.Dialer).DialContext(ctx, network, addr)
+						if err != nil {
+							return nil, err
+						}
+						rec = &frameRecorder{Conn: conn}
+						return rec, nil
+					},
+				},
+			}
+
+			conn, err := Dial(
+				context.Background(),
+				"ws://"+srv.Listener.Addr().String(),
+				WithHTTPClient(client),
+				WithCompression(testCase.Client, 1),
+			)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			c := NewClient(conn)
+			defer c.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			resp, err := c.Query(ctx, &Request{Query: query})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			if string(resp.Data) != strconv.Quote(query) {
+				subT.Logf("unexpected data: %.64s...", string(resp.Data))
+				subT.Fail()
+				return
+			}
+
+			// The query was the last message sent by the client
+			if rec.compressed() != testCase.Compressed {
+				subT.Logf("expected the query to be compressed: %v, but got: %v", testCase.Compressed, rec.compressed())
+				subT.Fail()
+				return
+			}
+			if compressed := rec.bytesRead() < len(query); compressed != testCase.Compressed {
+				subT.Logf("expected the response to be compressed: %v, but read %d bytes", testCase.Compressed, rec.bytesRead())
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestWithInsecureSkipVerify(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Opts   []ServerOption
+		Reject bool
+	}{
+		{
+			Name:   "Default",
+			Reject: true,
+		},
+		{
+			Name: "Origins",
+			Opts: []ServerOption{WithOrigins("example.com")},
+		},
+		{
+			Name: "SkipVerify",
+			Opts: []ServerOption{WithInsecureSkipVerify(true)},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler), testCase.Opts...))
+			defer srv.Close()
+
+			headers := make(http.Header)
+			headers.Set("Origin", "https://example.com")
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), WithHeaders(headers))
+			if testCase.Reject {
+				if err == nil {
+					conn.Close()
+					subT.Log("expected the cross origin connection to be rejected")
+					subT.Fail()
+				}
+				return
+			}
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			conn.Close()
+		})
+	}
+}
+
+func TestWithServerSubprotocols(t *testing.T) {
+	testCases := []struct {
+		Name     string
+		Opts     []ServerOption
+		Expected string
+	}{
+		{
+			Name:     "Default",
+			Expected: SubprotocolGraphQLWS,
+		},
+		{
+			Name:     "GraphQLTransportWSOnly",
+			Opts:     []ServerOption{WithServerSubprotocols(SubprotocolGraphQLTransportWS)},
+			Expected: SubprotocolGraphQLTransportWS,
+		},
+		{
+			Name:     "PreferGraphQLTransportWS",
+			Opts:     []ServerOption{WithServerSubprotocols(SubprotocolGraphQLTransportWS, SubprotocolGraphQLWS)},
+			Expected: SubprotocolGraphQLTransportWS,
+		},
+		{
+			Name:     "IgnoreUnsupported",
+			Opts:     []ServerOption{WithServerSubprotocols("graphql-unknown", SubprotocolGraphQLWS)},
+			Expected: SubprotocolGraphQLWS,
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler), testCase.Opts...))
+			defer srv.Close()
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			client := NewClient(conn)
+			defer client.Close()
+
+			if conn.Subprotocol() != testCase.Expected {
+				subT.Logf("expected subprotocol: %s, but got: %s", testCase.Expected, conn.Subprotocol())
+				subT.Fail()
+				return
+			}
+
+			ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+			defer cancel()
+
+			resp, err := client.Query(ctx, &Request{Query: "{ hello { world } }"})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			if len(resp.Data) == 0 {
+				subT.Log("expected response data")
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
 func TestServerKeepAlive(t *testing.T) {
 	opts := []ServerOption{
 		WithKeepAlive(500 * time.Millisecond),
@@ -101,6 +322,35 @@ func TestServerKeepAlive(t *testing.T) {
 	}
 }
 
+func TestServerKeepAlive_IdleClient(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler), WithKeepAlive(50*time.Millisecond)))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	client := NewClient(conn, WithKeepAliveTimeout(200*time.Millisecond))
+
+	_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Idle for longer than the keep alive timeout
+	time.Sleep(500 * time.Millisecond)
+
+	_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+}
+
 func TestStream_SendAfterClose(t *testing.T) {
 	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
 		s.Close()
@@ -241,8 +491,210 @@ func TestStream_StopOnMessage(t *testing.T) {
 	<-done
 }
 
-func TestErrMessage(t *testing.T) {
-	srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler)))
+func TestSubscriptionHandlerFunc(t *testing.T) {
+	t.Run("CompleteOnClose", func(subT *testing.T) {
+		srv := httptest.NewServer(NewSubscriptionHandler(func(ctx context.Context, req *Request) (<-chan *Response, error) {
+			results := make(chan *Response)
+			go func() {
+				defer close(results)
+
+				for i := 0; i < 3; i++ {
+					select {
+					case results <- &Response{Data: []byte(strconv.Itoa(i))}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return results, nil
+		}))
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		for i := 0; i < 3; i++ {
+			resp, err := sub.Recv(ctx)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			if string(resp.Data) != strconv.Itoa(i) {
+				subT.Logf("expected data: %d, but got: %s", i, string(resp.Data))
+				subT.Fail()
+				return
+			}
+		}
+
+		_, err = sub.Recv(ctx)
+		if err != ErrUnsubscribed {
+			subT.Logf("expected: %s, but got: %v", ErrUnsubscribed, err)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("CancelOnStop", func(subT *testing.T) {
+		cancelled := make(chan struct{})
+		srv := httptest.NewServer(NewSubscriptionHandler(func(ctx context.Context, req *Request) (<-chan *Response, error) {
+			results := make(chan *Response)
+			go func() {
+				defer close(results)
+
+				select {
+				case results <- &Response{Data: []byte(`{"hello":{"world":"sub"}}`)}:
+				case <-ctx.Done():
+				}
+
+				<-ctx.Done()
+				close(cancelled)
+			}()
+			return results, nil
+		}))
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		_, err = sub.Recv(ctx)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		err = sub.Unsubscribe()
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		select {
+		case <-cancelled:
+		case <-ctx.Done():
+			subT.Log("handler context was never cancelled")
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestSinkHandlerFunc(t *testing.T) {
+	testCases := []struct {
+		Name    string
+		Handler SinkHandlerFunc
+	}{
+		{
+			Name: "Complete",
+			Handler: func(ctx context.Context, req *Request, sink ResponseSink) error {
+				for i := 0; i < 3; i++ {
+					err := sink.Send(&Response{Data: []byte(strconv.Itoa(i))})
+					if err != nil {
+						return err
+					}
+				}
+				return sink.Complete()
+			},
+		},
+		{
+			Name: "CompleteOnReturn",
+			Handler: func(ctx context.Context, req *Request, sink ResponseSink) error {
+				for i := 0; i < 3; i++ {
+					err := sink.Send(&Response{Data: []byte(strconv.Itoa(i))})
+					if err != nil {
+						return err
+					}
+				}
+				return nil
+			},
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := httptest.NewServer(NewHandler(testCase.Handler))
+			defer srv.Close()
+
+			conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			client := NewClient(conn)
+			defer client.Close()
+
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+
+			for i := 0; i < 3; i++ {
+				resp, err := sub.Recv(ctx)
+				if err != nil {
+					subT.Error(err)
+					return
+				}
+				if string(resp.Data) != strconv.Itoa(i) {
+					subT.Logf("expected data: %d, but got: %s", i, string(resp.Data))
+					subT.Fail()
+					return
+				}
+			}
+
+			_, err = sub.Recv(ctx)
+			if err != ErrUnsubscribed {
+				subT.Logf("expected: %s, but got: %v", ErrUnsubscribed, err)
+				subT.Fail()
+				return
+			}
+		})
+	}
+}
+
+func TestStream_NoDataAfterStop(t *testing.T) {
+	cancelled := make(chan struct{})
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer close(cancelled)
+
+		for s.Context().Err() == nil {
+			s.Send(context.TODO(), &Response{Data: []byte(`{"hello":{"world":"sub"}}`)})
+		}
+		return nil
+	})))
 	defer srv.Close()
 
 	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
@@ -252,125 +704,1040 @@ func TestErrMessage(t *testing.T) {
 	}
 	defer conn.Close()
 
-	err = conn.write(context.Background(), operationMessage{Type: gqlConnectionInit})
-	if err != nil {
-		t.Error(err)
-		return
-	}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
 
-	// Should be ack message
-	_, err = conn.read(context.Background())
+	err = conn.init(ctx)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	err = conn.wc.Write(context.Background(), websocket.MessageBinary, []byte(`{"type":"start"`))
+	err = conn.write(ctx, operationMessage{ID: "1", Type: gqlStart, Payload: &Request{Query: "subscription { hello { world } }"}})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	b, err := conn.read(context.Background())
+	_, err = conn.read(ctx)
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	msg := new(operationMessage)
-	err = msg.UnmarshalJSON(b)
+	err = conn.write(ctx, operationMessage{ID: "1", Type: gqlStop})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	err, ok := msg.Payload.(error)
-	if !ok {
-		t.Log("expected error message from server")
+	select {
+	case <-cancelled:
+	case <-ctx.Done():
+		t.Log("handler context was never cancelled")
 		t.Fail()
 		return
 	}
 
-	var serr *ServerError
-	if !errors.As(err, &serr) {
-		t.Log("wrong error type:", err)
+	// Drain any data sent before the stop was received
+	msg := new(operationMessage)
+	for {
+		b, err := conn.read(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		msg.Type = ""
+		err = msg.UnmarshalJSON(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if msg.Type == gqlComplete {
+			break
+		}
+	}
+
+	rctx, rcancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer rcancel()
+
+	b, err := conn.read(rctx)
+	if err == nil {
+		t.Logf("received message after stop: %s", string(b))
 		t.Fail()
 		return
 	}
-	t.Log(serr)
 }
 
-func errHandler(*Stream, *Request) error {
-	return errors.New("test error from handler")
-}
+func TestHeadersFromContext(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
 
-func TestHandlerError(t *testing.T) {
-	srv := httptest.NewServer(NewHandler(HandlerFunc(errHandler)))
+		auth := HeadersFromContext(s.Context()).Get("Authorization")
+		return s.Send(context.TODO(), &Response{Data: []byte(strconv.Quote(auth))})
+	})))
 	defer srv.Close()
 
-	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	headers := make(http.Header)
+	headers.Set("Authorization", "Bearer token")
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String(), WithHeaders(headers))
 	if err != nil {
 		t.Error(err)
 		return
 	}
-	defer conn.Close()
 
-	err = conn.write(context.Background(), operationMessage{Type: gqlConnectionInit})
+	client := NewClient(conn)
+	defer client.Close()
+
+	resp, err := client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
 	if err != nil {
 		t.Error(err)
 		return
 	}
 
-	// Should be ack message
-	_, err = conn.read(context.Background())
-	if err != nil {
-		t.Error(err)
+	if string(resp.Data) != `"Bearer token"` {
+		t.Logf("expected authorization header but got: %s", string(resp.Data))
+		t.Fail()
 		return
 	}
+}
 
-	err = conn.write(context.Background(), operationMessage{
-		ID:      "1",
-		Type:    gqlStart,
-		Payload: &Request{Query: "{ hello { world } }"},
+func TestWithConnectionInitTimeout(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(errHandler), WithConnectionInitTimeout(100*time.Millisecond)))
+	defer srv.Close()
+
+	t.Run("NeverInitialized", func(subT *testing.T) {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		wc, _, err := websocket.Dial(ctx, "ws://"+srv.Listener.Addr().String(), &websocket.DialOptions{
+			Subprotocols: []string{SubprotocolGraphQLTransportWS},
+		})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		defer wc.Close(websocket.StatusNormalClosure, "closed")
+
+		_, _, err = wc.Read(ctx)
+		if websocket.CloseStatus(err) != websocket.StatusCode(CloseInitTimeout) {
+			subT.Logf("expected close status: %d, got: %v", CloseInitTimeout, err)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Initialized", func(subT *testing.T) {
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		time.Sleep(200 * time.Millisecond)
+
+		_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+		var serr *ServerError
+		if !errors.As(err, &serr) {
+			subT.Logf("expected server error but got: %v", err)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestDuplicateConnectionInit(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(errHandler)))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wc, _, err := websocket.Dial(ctx, "ws://"+srv.Listener.Addr().String(), &websocket.DialOptions{
+		Subprotocols: []string{SubprotocolGraphQLTransportWS},
 	})
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	defer wc.Close(websocket.StatusNormalClosure, "closed")
 
-	b, err := conn.read(context.Background())
+	for i := 0; i < 2; i++ {
+		err = wc.Write(ctx, websocket.MessageText, []byte(`{"type":"connection_init"}`))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+	}
+
+	_, b, err := wc.Read(ctx)
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	if string(b) != `{"type":"connection_ack"}`+"\n" {
+		t.Logf("expected connection_ack but got: %s", b)
+		t.Fail()
+		return
+	}
 
-	msg := new(operationMessage)
-	err = msg.UnmarshalJSON(b)
+	_, _, err = wc.Read(ctx)
+	if websocket.CloseStatus(err) != websocket.StatusCode(CloseTooManyInitRequests) {
+		t.Logf("expected close status: %d, got: %v", CloseTooManyInitRequests, err)
+		t.Fail()
+		return
+	}
+}
+
+func TestDuplicateSubscriber(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		<-s.Context().Done()
+		return nil
+	})))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wc, _, err := websocket.Dial(ctx, "ws://"+srv.Listener.Addr().String(), &websocket.DialOptions{
+		Subprotocols: []string{SubprotocolGraphQLTransportWS},
+	})
 	if err != nil {
 		t.Error(err)
 		return
 	}
+	defer wc.Close(websocket.StatusNormalClosure, "closed")
 
-	err, ok := msg.Payload.(error)
-	if !ok {
-		t.Log("expected error message from server")
-		t.Fail()
-		return
+	msgs := []string{
+		`{"type":"connection_init"}`,
+		`{"id":"1","type":"subscribe","payload":{"query":"subscription { hello }"}}`,
+		`{"id":"1","type":"subscribe","payload":{"query":"subscription { hello }"}}`,
+	}
+	for _, msg := range msgs {
+		err = wc.Write(ctx, websocket.MessageText, []byte(msg))
+		if err != nil {
+			t.Error(err)
+			return
+		}
 	}
 
-	var serr *ServerError
-	if !errors.As(err, &serr) {
-		t.Log("wrong error type:", err)
+	for {
+		_, _, err = wc.Read(ctx)
+		if err != nil {
+			break
+		}
+	}
+	if websocket.CloseStatus(err) != websocket.StatusCode(CloseSubscriberExists) {
+		t.Logf("expected close status: %d, got: %v", CloseSubscriberExists, err)
 		t.Fail()
 		return
 	}
-	t.Log(serr)
 }
 
-var (
-	loadTest = flag.Bool("load", false, "Run server load test")
-	port     = flag.Uint("port", 4200, "Specify local port for server to listen on")
-)
+func TestReuseCompletedOperationID(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		return s.Close()
+	})))
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	wc, _, err := websocket.Dial(ctx, "ws://"+srv.Listener.Addr().String(), &websocket.DialOptions{
+		Subprotocols: []string{SubprotocolGraphQLTransportWS},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer wc.Close(websocket.StatusNormalClosure, "closed")
+
+	msgs := []string{
+		`{"type":"connection_init"}`,
+		`{"id":"1","type":"subscribe","payload":{"query":"subscription { hello }"}}`,
+		`{"id":"1","type":"subscribe","payload":{"query":"subscription { hello }"}}`,
+	}
+	expected := []string{
+		`{"type":"connection_ack"}`,
+		`{"id":"1","type":"complete"}`,
+		`{"id":"1","type":"complete"}`,
+	}
+	for i, msg := range msgs {
+		err = wc.Write(ctx, websocket.MessageText, []byte(msg))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		_, b, err := wc.Read(ctx)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if string(b) != expected[i]+"\n" {
+			t.Logf("expected: %s, got: %s", expected[i], b)
+			t.Fail()
+			return
+		}
+	}
+}
+
+func TestWithMaxConcurrentOps(t *testing.T) {
+	const n = 3
+
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		<-s.Context().Done()
+		return nil
+	}), WithMaxConcurrentOps(n)))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	subs := make([]*Subscription, n+1)
+	for i := range subs {
+		subs[i], err = client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		defer subs[i].Unsubscribe()
+	}
+
+	_, err = subs[n].Recv(ctx)
+	var serr *ServerError
+	if !errors.As(err, &serr) || serr.Msg != errTooManyOps.Error() {
+		t.Logf("expected the operation to be rejected, but got: %v", err)
+		t.Fail()
+		return
+	}
+	subs[n].Unsubscribe()
+
+	// Completing an operation makes room for another
+	err = subs[0].Unsubscribe()
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer sub.Unsubscribe()
+
+	rctx, rcancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer rcancel()
+
+	_, err = sub.Recv(rctx)
+	if err != context.DeadlineExceeded {
+		t.Logf("expected the operation to be accepted, but got: %v", err)
+		t.Fail()
+		return
+	}
+}
+
+func TestWithConnectionInitFunc(t *testing.T) {
+	type userKey struct{}
+
+	initFunc := func(ctx context.Context, params json.RawMessage) (context.Context, error) {
+		var p struct {
+			AuthToken string `json:"authToken"`
+		}
+		err := json.Unmarshal(params, &p)
+		if err != nil {
+			return nil, err
+		}
+		if p.AuthToken != "secret" {
+			return nil, errors.New("unauthorized")
+		}
+		return context.WithValue(ctx, userKey{}, "gopher"), nil
+	}
+
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		user, _ := s.Context().Value(userKey{}).(string)
+		return s.Send(context.TODO(), &Response{Data: []byte(strconv.Quote(user))})
+	}), WithConnectionInitFunc(initFunc)))
+	defer srv.Close()
+
+	t.Run("Accept", func(subT *testing.T) {
+		conn, err := Dial(
+			context.Background(),
+			"ws://"+srv.Listener.Addr().String(),
+			WithConnectionParams(map[string]interface{}{"authToken": "secret"}),
+		)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		resp, err := client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		if string(resp.Data) != `"gopher"` {
+			subT.Logf("expected context value but got: %s", string(resp.Data))
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Reject", func(subT *testing.T) {
+		conn, err := Dial(
+			context.Background(),
+			"ws://"+srv.Listener.Addr().String(),
+			WithConnectionParams(map[string]interface{}{"authToken": "wrong"}),
+		)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		_, err = client.Query(context.Background(), &Request{Query: "{ hello { world } }"})
+
+		var cerr *ConnectionError
+		if !errors.As(err, &cerr) {
+			subT.Logf("wrong error: %v", err)
+			subT.Fail()
+			return
+		}
+		if string(cerr.Payload) != `{"message":"unauthorized"}` {
+			subT.Logf("unexpected payload: %s", string(cerr.Payload))
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestErrTerminate(t *testing.T) {
+	initFunc := func(ctx context.Context, params json.RawMessage) (context.Context, error) {
+		if string(params) == `{"revoked":true}` {
+			return nil, ErrTerminate{Code: CloseUnauthorized, Reason: "revoked"}
+		}
+		return ctx, nil
+	}
+
+	streams := make(chan *Stream, 1)
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		streams <- s
+		if req.OperationName == "default" {
+			return ErrTerminate{Reason: "default"}
+		}
+		return fmt.Errorf("resolving: %w", ErrTerminate{Code: 4000, Reason: "rate limited"})
+	}), WithConnectionInitFunc(initFunc), WithServerSubprotocols(SubprotocolGraphQLWS, SubprotocolGraphQLTransportWS)))
+	defer srv.Close()
+
+	testCases := []struct {
+		Name   string
+		Proto  string
+		Msgs   []string
+		Code   CloseCode
+		Reason string
+	}{
+		{
+			Name:   "Handler",
+			Proto:  SubprotocolGraphQLWS,
+			Msgs:   []string{`{"type":"connection_init"}`, `{"id":"1","type":"start","payload":{"query":"{ hello }"}}`},
+			Code:   4000,
+			Reason: "rate limited",
+		},
+		{
+			Name:   "Handler/graphql-transport-ws",
+			Proto:  SubprotocolGraphQLTransportWS,
+			Msgs:   []string{`{"type":"connection_init"}`, `{"id":"1","type":"subscribe","payload":{"query":"{ hello }"}}`},
+			Code:   4000,
+			Reason: "rate limited",
+		},
+		{
+			Name:   "Handler/DefaultCode",
+			Proto:  SubprotocolGraphQLTransportWS,
+			Msgs:   []string{`{"type":"connection_init"}`, `{"id":"1","type":"subscribe","payload":{"query":"{ hello }","operationName":"default"}}`},
+			Code:   CloseForbidden,
+			Reason: "default",
+		},
+		{
+			Name:   "ConnectionInitFunc",
+			Proto:  SubprotocolGraphQLWS,
+			Msgs:   []string{`{"type":"connection_init","payload":{"revoked":true}}`},
+			Code:   CloseUnauthorized,
+			Reason: "revoked",
+		},
+	}
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+			defer cancel()
+
+			wc, _, err := websocket.Dial(ctx, "ws://"+srv.Listener.Addr().String(), &websocket.DialOptions{
+				Subprotocols: []string{testCase.Proto},
+			})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			defer wc.Close(websocket.StatusNormalClosure, "closed")
+
+			for _, msg := range testCase.Msgs {
+				err = wc.Write(ctx, websocket.MessageText, []byte(msg))
+				if err != nil {
+					subT.Error(err)
+					return
+				}
+			}
+
+			var connErr []byte
+			for {
+				var b []byte
+				_, b, err = wc.Read(ctx)
+				if err != nil {
+					break
+				}
+				if bytes.Contains(b, []byte(`"connection_error"`)) {
+					connErr = bytes.TrimSpace(b)
+				}
+			}
+
+			var cerr websocket.CloseError
+			if !errors.As(err, &cerr) || cerr.Code != websocket.StatusCode(testCase.Code) || cerr.Reason != testCase.Reason {
+				subT.Logf("expected close status: %d (%s), but got: %v", testCase.Code, testCase.Reason, err)
+				subT.Fail()
+				return
+			}
+
+			expected := `{"type":"connection_error","payload":{"message":"` + testCase.Reason + `"}}`
+			if testCase.Proto == SubprotocolGraphQLTransportWS {
+				expected = ""
+			}
+			if string(connErr) != expected {
+				subT.Logf("expected connection_error: %s, but got: %s", expected, string(connErr))
+				subT.Fail()
+				return
+			}
+
+			// The handler's stream is ended before the connection is closed
+			select {
+			case s := <-streams:
+				if s.Context().Err() == nil || s.Send(ctx, &Response{}) != ErrStreamClosed {
+					subT.Log("expected the handler's stream to have ended")
+					subT.Fail()
+					return
+				}
+			default:
+			}
+		})
+	}
+}
+
+func TestMissingRequestPayload(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler)))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+
+	err = conn.init(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = conn.write(ctx, operationMessage{ID: "1", Type: gqlSubscribe})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	b, err := conn.read(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	msg := new(operationMessage)
+	err = msg.UnmarshalJSON(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	if msg.ID != "1" || msg.Type != gqlError {
+		t.Logf("expected an error for the operation but got: %s", string(b))
+		t.Fail()
+		return
+	}
+}
+
+func TestHandler_Stats(t *testing.T) {
+	received := make(chan struct{}, 1)
+	release := make(chan struct{})
+	h := NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		received <- struct{}{}
+		<-release
+		return testHandler(s, req)
+	}))
+
+	srv := httptest.NewServer(h)
+	defer srv.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	var clients []Client
+	for i := 0; i < 2; i++ {
+		conn, err := Dial(ctx, "ws://"+srv.Listener.Addr().String(), WithAckTimeout(time.Second))
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		client := NewClient(conn)
+		defer client.Close()
+		clients = append(clients, client)
+	}
+
+	errCh := make(chan error, 1)
+	go func() {
+		_, err := clients[0].Query(ctx, &Request{Query: "{ hello { world } }"})
+		errCh <- err
+	}()
+	<-received
+
+	stats := h.Stats()
+	if stats.Connections != 2 || stats.Operations != 1 || stats.ShuttingDown {
+		t.Logf("unexpected stats: %+v", stats)
+		t.Fail()
+		return
+	}
+	if n := h.Connections(); n != 2 {
+		t.Logf("expected 2 connections, but got: %d", n)
+		t.Fail()
+		return
+	}
+
+	close(release)
+	err := <-errCh
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = h.Shutdown(ctx)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	stats = h.Stats()
+	if stats.Connections != 0 || stats.Operations != 0 || !stats.ShuttingDown {
+		t.Logf("unexpected stats after shutdown: %+v", stats)
+		t.Fail()
+		return
+	}
+}
+
+func TestHandler_Shutdown(t *testing.T) {
+	t.Run("Drain", func(subT *testing.T) {
+		received := make(chan struct{})
+		h := NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+			close(received)
+			time.Sleep(100 * time.Millisecond)
+			return testHandler(s, req)
+		}))
+
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		errCh := make(chan error, 1)
+		go func() {
+			_, err := client.Query(ctx, &Request{Query: "{ hello { world } }"})
+			errCh <- err
+		}()
+
+		<-received
+		err = h.Shutdown(ctx)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		err = <-errCh
+		if err != nil {
+			subT.Logf("expected in-flight query to finish but got: %s", err)
+			subT.Fail()
+			return
+		}
+
+		_, err = Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err == nil {
+			subT.Log("expected new connections to be rejected")
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Timeout", func(subT *testing.T) {
+		h := NewSubscriptionHandler(func(ctx context.Context, req *Request) (<-chan *Response, error) {
+			results := make(chan *Response)
+			go func() {
+				defer close(results)
+
+				for {
+					select {
+					case results <- &Response{Data: []byte(`{"hello":{"world":"sub"}}`)}:
+					case <-ctx.Done():
+						return
+					}
+				}
+			}()
+			return results, nil
+		})
+
+		srv := httptest.NewServer(h)
+		defer srv.Close()
+
+		conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		client := NewClient(conn)
+		defer client.Close()
+
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello { world } }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		_, err = sub.Recv(ctx)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+
+		sctx, scancel := context.WithTimeout(ctx, 100*time.Millisecond)
+		defer scancel()
+
+		err = h.Shutdown(sctx)
+		if err != context.DeadlineExceeded {
+			subT.Logf("expected: %s, but got: %v", context.DeadlineExceeded, err)
+			subT.Fail()
+			return
+		}
+
+		// The subscription is completed once the deadline passes
+		for {
+			_, err = sub.Recv(ctx)
+			if err != nil {
+				break
+			}
+		}
+		if err == context.DeadlineExceeded {
+			subT.Log("subscription was never completed")
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestErrMessage(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(testHandler)))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	err = conn.write(context.Background(), operationMessage{Type: gqlConnectionInit})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Should be ack message
+	_, err = conn.read(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = conn.wc.Write(context.Background(), websocket.MessageBinary, []byte(`{"type":"start"`))
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	b, err := conn.read(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	msg := new(operationMessage)
+	err = msg.UnmarshalJSON(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err, ok := msg.Payload.(error)
+	if !ok {
+		t.Log("expected error message from server")
+		t.Fail()
+		return
+	}
+
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Log("wrong error type:", err)
+		t.Fail()
+		return
+	}
+	t.Log(serr)
+}
+
+func errHandler(*Stream, *Request) error {
+	return errors.New("test error from handler")
+}
+
+func TestHandlerError(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(errHandler)))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	err = conn.write(context.Background(), operationMessage{Type: gqlConnectionInit})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Should be ack message
+	_, err = conn.read(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = conn.write(context.Background(), operationMessage{
+		ID:      "1",
+		Type:    gqlStart,
+		Payload: &Request{Query: "{ hello { world } }"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	b, err := conn.read(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	msg := new(operationMessage)
+	err = msg.UnmarshalJSON(b)
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err, ok := msg.Payload.(error)
+	if !ok {
+		t.Log("expected error message from server")
+		t.Fail()
+		return
+	}
+
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Log("wrong error type:", err)
+		t.Fail()
+		return
+	}
+	t.Log(serr)
+}
+
+func TestHandlerError_EndsStream(t *testing.T) {
+	streams := make(chan *Stream, 1)
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		streams <- s
+		return errors.New("failed")
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	client := NewClient(conn)
+	defer client.Close()
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	_, err = client.Query(ctx, &Request{Query: "{ hello { world } }"})
+	var serr *ServerError
+	if !errors.As(err, &serr) {
+		t.Logf("expected a server error, but got: %v", err)
+		t.Fail()
+		return
+	}
+
+	// The error is only sent once the stream has ended
+	s := <-streams
+	if s.Context().Err() == nil {
+		t.Log("expected the stream context to be done")
+		t.Fail()
+		return
+	}
+
+	err = s.Send(ctx, &Response{Data: []byte(`{}`)})
+	if err != ErrStreamClosed {
+		t.Logf("expected: %v, but got: %v", ErrStreamClosed, err)
+		t.Fail()
+		return
+	}
+}
+
+var (
+	loadTest = flag.Bool("load", false, "Run server load test")
+	port     = flag.Uint("port", 4200, "Specify local port for server to listen on")
+)
+
+func TestHandlerGraphQLErrors(t *testing.T) {
+	srv := httptest.NewServer(NewHandler(HandlerFunc(func(s *Stream, req *Request) error {
+		defer s.Close()
+
+		return s.Send(context.TODO(), &Response{
+			Data:   []byte(`{"hello":null}`),
+			Errors: []json.RawMessage{[]byte(`{"message":"resolver failed","path":["hello"]}`)},
+		})
+	})))
+	defer srv.Close()
+
+	conn, err := Dial(context.Background(), "ws://"+srv.Listener.Addr().String())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+	defer conn.Close()
+
+	err = conn.write(context.Background(), operationMessage{Type: gqlConnectionInit})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	// Should be ack message
+	_, err = conn.read(context.Background())
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	err = conn.write(context.Background(), operationMessage{
+		ID:      "1",
+		Type:    gqlStart,
+		Payload: &Request{Query: "{ hello }"},
+	})
+	if err != nil {
+		t.Error(err)
+		return
+	}
+
+	for _, typ := range []reqType{gqlData, gqlComplete} {
+		b, err := conn.read(context.Background())
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		msg := new(operationMessage)
+		err = msg.UnmarshalJSON(b)
+		if err != nil {
+			t.Error(err)
+			return
+		}
+
+		if msg.Type != typ {
+			t.Logf("expected message type: %s, but got: %s", typ, msg.Type)
+			t.Fail()
+			return
+		}
+		if typ != gqlData {
+			continue
+		}
+
+		resp := msg.Payload.(*Response)
+		errs, err := resp.GraphQLErrors()
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		if len(errs) != 1 || errs[0].Message != "resolver failed" {
+			t.Logf("unexpected errors: %v", errs)
+			t.Fail()
+			return
+		}
+	}
+}
 
 func TestServerLoad(t *testing.T) {
 	if !*loadTest {
@@ -0,0 +1,395 @@
+package gws
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// ErrUnexpectedStatus is returned by clients created with DialSSE
+// when the server responds with a non-200 HTTP status code.
+//
+type ErrUnexpectedStatus int
+
+// Error implements the error interface.
+func (e ErrUnexpectedStatus) Error() string {
+	return "gws: unexpected http status: " + strconv.Itoa(int(e)) + " " + http.StatusText(int(e))
+}
+
+// DialSSE returns a Client which performs operations over Server-Sent Events,
+// as described by the "distinct connections mode" of the graphql-sse protocol.
+// See https://github.com/enisdenjo/graphql-sse/blob/master/PROTOCOL.md
+//
+// It is intended as a fallback for environments where WebSockets aren't
+// available e.g. behind restrictive proxies, when Dial fails to upgrade.
+// Since every operation is performed with its own HTTP request, no
+// connection is established up front and Ping isn't supported.
+//
+// Only the HTTP client, headers, origin, bearer token, proxy, dialer and TLS
+// options apply.
+//
+func DialSSE(endpoint string, opts ...DialOption) (Client, error) {
+	dopts := &dialOpts{
+		client: http.DefaultClient,
+	}
+	for _, opt := range opts {
+		opt.SetDial(dopts)
+	}
+
+	err := dopts.applyTransport()
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	return &sseClient{
+		endpoint: endpoint,
+		client:   dopts.client,
+		header:   dopts.header,
+		ctx:      ctx,
+		cancel:   cancel,
+		ops:      make(map[OperationID]chan struct{}),
+	}, nil
+}
+
+type sseClient struct {
+	endpoint string
+	client   *http.Client
+	header   func(context.Context) (http.Header, error)
+
+	// cancelled by Close
+	ctx    context.Context
+	cancel context.CancelFunc
+
+	// in-flight operations, for Wait
+	id  uint64
+	mu  sync.Mutex
+	ops map[OperationID]chan struct{}
+}
+
+// track starts tracking an in-flight operation, until the returned func
+// is called. The operation's id is only known to the client, since the
+// operation has its own request.
+//
+func (c *sseClient) track() (OperationID, func()) {
+	id := OperationID(strconv.FormatUint(atomic.AddUint64(&c.id, 1), 10))
+	ended := make(chan struct{})
+
+	c.mu.Lock()
+	c.ops[id] = ended
+	c.mu.Unlock()
+
+	return id, func() {
+		c.mu.Lock()
+		delete(c.ops, id)
+		c.mu.Unlock()
+		close(ended)
+	}
+}
+
+func (c *sseClient) ActiveOperations() []OperationID {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	ids := make([]OperationID, 0, len(c.ops))
+	for id := range c.ops {
+		ids = append(ids, id)
+	}
+	sortIDs(ids)
+	return ids
+}
+
+func (c *sseClient) Wait(ctx context.Context) error {
+	c.mu.Lock()
+	ops := make([]chan struct{}, 0, len(c.ops))
+	for _, ended := range c.ops {
+		ops = append(ops, ended)
+	}
+	c.mu.Unlock()
+
+	for _, ended := range ops {
+		select {
+		case <-ctx.Done():
+			return ctx.Err()
+		case <-ended:
+		}
+	}
+	return nil
+}
+
+func (c *sseClient) Query(ctx context.Context, req *Request) (*Response, error) {
+	_, end := c.track()
+	defer end()
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	go func() {
+		select {
+		case <-c.ctx.Done():
+			cancel()
+		case <-ctx.Done():
+		}
+	}()
+
+	events, err := c.open(ctx, req)
+	if err != nil {
+		return nil, err
+	}
+	defer events.Close()
+
+	// Incremental results are appended to the initial
+	// response, until the server indicates there are no more.
+	//
+	var resp *Response
+	for {
+		typ, data, err := events.Next()
+		if err != nil {
+			return nil, c.ioErr(err)
+		}
+
+		switch typ {
+		case "next":
+			r := new(Response)
+			if err = json.Unmarshal(data, r); err != nil {
+				return r, err
+			}
+			if resp == nil {
+				resp = r
+			} else {
+				resp.Incremental = append(resp.Incremental, r.Incremental...)
+				resp.Errors = append(resp.Errors, r.Errors...)
+				resp.HasNext = r.HasNext
+			}
+			if !resp.HasNext {
+				return resp, nil
+			}
+		case "complete":
+			if resp == nil {
+				// Completed without a result e.g. an empty result set
+				return &Response{}, nil
+			}
+			// Completed without a final result
+			resp.HasNext = false
+			return resp, nil
+		}
+	}
+}
+
+func (c *sseClient) Mutation(ctx context.Context, req *Request) (*Response, error) {
+	return c.Query(ctx, req)
+}
+
+func (c *sseClient) QueryBatch(ctx context.Context, reqs []*Request) ([]*Response, []error) {
+	resps := make([]*Response, len(reqs))
+	errs := make([]error, len(reqs))
+
+	var wg sync.WaitGroup
+	wg.Add(len(reqs))
+	for i, req := range reqs {
+		go func(i int, req *Request) {
+			defer wg.Done()
+			resps[i], errs[i] = c.Query(ctx, req)
+		}(i, req)
+	}
+	wg.Wait()
+
+	return resps, errs
+}
+
+func (c *sseClient) Subscribe(ctx context.Context, req *Request) (*Subscription, error) {
+	id, end := c.track()
+
+	// The request lasts as long as ctx, unless the client is closed first
+	sctx, cancel := context.WithCancel(c.ctx)
+	go func() {
+		select {
+		case <-ctx.Done():
+			cancel()
+		case <-sctx.Done():
+		}
+	}()
+
+	events, err := c.open(sctx, req)
+	if err != nil {
+		end()
+		cancel()
+		if ctx.Err() != nil {
+			return nil, ctx.Err()
+		}
+		return nil, err
+	}
+
+	respCh := make(chan qResp)
+	done := make(chan struct{}, 1)
+	go func() {
+		defer end()
+		defer close(respCh)
+		defer events.Close()
+		defer cancel()
+
+		for {
+			typ, data, err := events.Next()
+			var r qResp
+			switch {
+			case err != nil && sctx.Err() != nil:
+				return
+			case err != nil:
+				r.err = c.ioErr(err)
+			case typ == "next":
+				r.resp = new(Response)
+				r.err = json.Unmarshal(data, r.resp)
+			case typ == "complete":
+				return
+			default:
+				continue
+			}
+
+			select {
+			case respCh <- r:
+			case <-done:
+				return
+			}
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	return &Subscription{
+		id:     id,
+		respCh: respCh,
+		done:   done,
+		stop: func() error {
+			cancel()
+			return nil
+		},
+		onResponse: func(context.Context, *Response, error) {},
+	}, nil
+}
+
+func (c *sseClient) Ping(ctx context.Context) error {
+	return ErrPingUnsupported
+}
+
+// InvalidateCache does nothing, since responses are never cached.
+func (c *sseClient) InvalidateCache() {}
+
+// AckPayload always returns nil, since there's no connection_init handshake.
+func (c *sseClient) AckPayload() json.RawMessage {
+	return nil
+}
+
+func (c *sseClient) Close() error {
+	c.cancel()
+	return nil
+}
+
+// open starts the operation and returns the stream of events in response.
+func (c *sseClient) open(ctx context.Context, req *Request) (*sseReader, error) {
+	if c.ctx.Err() != nil {
+		return nil, ErrClientClosed
+	}
+	if err := checkVariables(nil, req.Variables); err != nil {
+		return nil, err
+	}
+
+	b, err := json.Marshal(req)
+	if err != nil {
+		return nil, err
+	}
+
+	hreq, err := http.NewRequestWithContext(ctx, http.MethodPost, c.endpoint, bytes.NewReader(b))
+	if err != nil {
+		return nil, err
+	}
+	headers, err := c.header(ctx)
+	if err != nil {
+		return nil, err
+	}
+	for k, v := range headers {
+		hreq.Header[k] = v
+	}
+	hreq.Header.Set("Content-Type", "application/json")
+	hreq.Header.Set("Accept", "text/event-stream")
+
+	resp, err := c.client.Do(hreq)
+	if err != nil {
+		return nil, c.ioErr(err)
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, ErrUnexpectedStatus(resp.StatusCode)
+	}
+
+	return &sseReader{
+		r:    bufio.NewReader(resp.Body),
+		body: resp.Body,
+	}, nil
+}
+
+func (c *sseClient) ioErr(err error) error {
+	if c.ctx.Err() != nil {
+		return ErrClientClosed
+	}
+	return ErrIO{
+		Msg: "failed to read event stream",
+		Err: err,
+	}
+}
+
+// sseReader reads events from a text/event-stream.
+type sseReader struct {
+	r    *bufio.Reader
+	body io.Closer
+}
+
+// Next returns the type and data of the next event.
+func (s *sseReader) Next() (typ string, data []byte, err error) {
+	var buf bytes.Buffer
+	var hasData bool
+	for {
+		line, err := s.r.ReadString('\n')
+		if err == io.EOF && line == "" {
+			return "", nil, io.ErrUnexpectedEOF
+		}
+		if err != nil && err != io.EOF {
+			return "", nil, err
+		}
+		line = strings.TrimRight(line, "\r\n")
+
+		if line == "" {
+			if typ == "" && !hasData {
+				continue
+			}
+			return typ, buf.Bytes(), nil
+		}
+
+		field, value := line, ""
+		if i := strings.IndexByte(line, ':'); i >= 0 {
+			field, value = line[:i], strings.TrimPrefix(line[i+1:], " ")
+		}
+
+		switch field {
+		case "event":
+			typ = value
+		case "data":
+			if hasData {
+				buf.WriteByte('\n')
+			}
+			buf.WriteString(value)
+			hasData = true
+		}
+	}
+}
+
+// Close closes the underlying response body.
+func (s *sseReader) Close() error {
+	return s.body.Close()
+}
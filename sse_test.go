@@ -0,0 +1,240 @@
+package gws
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func newSSEServer(n int) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req Request
+		err := json.NewDecoder(r.Body).Decode(&req)
+		if err != nil || r.Header.Get("Accept") != "text/event-stream" {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		w.Header().Set("Content-Type", "text/event-stream")
+		w.WriteHeader(http.StatusOK)
+
+		for i := 0; i < n; i++ {
+			fmt.Fprintf(w, ": keep alive\n\nevent: next\ndata: {\"data\":%d}\n\n", i)
+			w.(http.Flusher).Flush()
+		}
+		fmt.Fprint(w, "event: complete\ndata:\n\n")
+	}))
+}
+
+func TestDialSSE(t *testing.T) {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	t.Run("Query", func(subT *testing.T) {
+		srv := newSSEServer(1)
+		defer srv.Close()
+
+		client, err := DialSSE(srv.URL)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		defer client.Close()
+
+		resp, err := client.Query(ctx, &Request{Query: "{ hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		if string(resp.Data) != "0" {
+			subT.Logf("unexpected response: %s", resp.Data)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("EmptyResult", func(subT *testing.T) {
+		srv := newSSEServer(0)
+		defer srv.Close()
+
+		client, err := DialSSE(srv.URL)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		defer client.Close()
+
+		resp, err := client.Query(ctx, &Request{Query: "{ hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		if resp == nil || resp.Data != nil || resp.Errors != nil {
+			subT.Logf("expected an empty response but got: %#v", resp)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Subscribe", func(subT *testing.T) {
+		srv := newSSEServer(3)
+		defer srv.Close()
+
+		client, err := DialSSE(srv.URL)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		defer client.Close()
+
+		sub, err := client.Subscribe(ctx, &Request{Query: "subscription { hello }"})
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		defer sub.Unsubscribe()
+
+		for i := 0; i < 3; i++ {
+			resp, err := sub.Recv(ctx)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			if string(resp.Data) != strconv.Itoa(i) {
+				subT.Logf("expected: %d, got: %s", i, resp.Data)
+				subT.Fail()
+				return
+			}
+		}
+
+		_, err = sub.Recv(ctx)
+		if err != ErrUnsubscribed {
+			subT.Logf("expected subscription to complete but got: %v", err)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("UnexpectedStatus", func(subT *testing.T) {
+		srv := httptest.NewServer(http.NotFoundHandler())
+		defer srv.Close()
+
+		client, err := DialSSE(srv.URL)
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		defer client.Close()
+
+		_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+		if err != ErrUnexpectedStatus(http.StatusNotFound) {
+			subT.Logf("expected: %v, got: %v", ErrUnexpectedStatus(http.StatusNotFound), err)
+			subT.Fail()
+			return
+		}
+	})
+
+	t.Run("Closed", func(subT *testing.T) {
+		client, err := DialSSE("http://localhost")
+		if err != nil {
+			subT.Error(err)
+			return
+		}
+		client.Close()
+
+		_, err = client.Query(ctx, &Request{Query: "{ hello }"})
+		if err != ErrClientClosed {
+			subT.Logf("expected: %v, got: %v", ErrClientClosed, err)
+			subT.Fail()
+			return
+		}
+	})
+}
+
+func TestSSEClient_IncrementalDelivery(t *testing.T) {
+	testCases := []struct {
+		Name   string
+		Events []string
+	}{
+		{
+			Name: "HasNext",
+			Events: []string{
+				`{"data":{"hero":{"name":"R2-D2"}},"hasNext":true}`,
+				`{"incremental":[{"data":{"friends":[]},"path":["hero"]}],"hasNext":true}`,
+				`{"errors":[{"message":"partial failure"}],"incremental":[{"items":["Luke"],"path":["hero","friends",0]}]}`,
+			},
+		},
+		{
+			Name: "Complete",
+			Events: []string{
+				`{"data":{"hero":{"name":"R2-D2"}},"hasNext":true}`,
+				`{"incremental":[{"data":{"friends":[]},"path":["hero"]}],"hasNext":true}`,
+				`{"errors":[{"message":"partial failure"}],"incremental":[{"items":["Luke"],"path":["hero","friends",0]}],"hasNext":true}`,
+				"", // completes before the final result
+			},
+		},
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	for _, testCase := range testCases {
+		t.Run(testCase.Name, func(subT *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				w.Header().Set("Content-Type", "text/event-stream")
+				w.WriteHeader(http.StatusOK)
+
+				for _, data := range testCase.Events {
+					if data == "" {
+						fmt.Fprint(w, "event: complete\ndata:\n\n")
+						continue
+					}
+					fmt.Fprintf(w, "event: next\ndata: %s\n\n", data)
+				}
+				w.(http.Flusher).Flush()
+
+				// The final result must end the query without waiting for complete
+				<-r.Context().Done()
+			}))
+			defer srv.Close()
+
+			client, err := DialSSE(srv.URL)
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			defer client.Close()
+
+			resp, err := client.Query(ctx, &Request{Query: "{ hero { name ... @defer { friends @stream { name } } } }"})
+			if err != nil {
+				subT.Error(err)
+				return
+			}
+			if string(resp.Data) != `{"hero":{"name":"R2-D2"}}` {
+				subT.Logf("unexpected initial data: %s", resp.Data)
+				subT.Fail()
+				return
+			}
+			if resp.HasNext {
+				subT.Log("expected the final result to have been received")
+				subT.Fail()
+				return
+			}
+			if len(resp.Incremental) != 2 || len(resp.Errors) != 1 {
+				subT.Logf("expected all incremental results and errors, but got: %s, %s", resp.Incremental, resp.Errors)
+				subT.Fail()
+				return
+			}
+			if string(resp.Incremental[1]) != `{"items":["Luke"],"path":["hero","friends",0]}` {
+				subT.Logf("incremental results are out of order: %s", resp.Incremental)
+				subT.Fail()
+				return
+			}
+		})
+	}
+}